@@ -1,4 +1,4 @@
-package main
+package siren
 
 import (
 	"errors"
@@ -11,19 +11,19 @@ import (
 	"github.com/LEW21/siren/imagectl"
 )
 
-func ReadMetadata(commands_in [][]string) (id, tag, name, version, baseName string, baseSources []string, commands [][]string, err error) {
+func ReadMetadata(commands_in []Instruction) (id, tag, name, version, baseName string, baseSources []string, commands []Instruction, err error) {
 	commands = commands_in
 
-	var idCmd, fromCmd []string
+	var idCmd, fromCmd *Instruction
 
 	done := false
 	for len(commands) > 0 && !done {
-		switch commands[0][0] {
+		switch commands[0].Args[0] {
 			case "ID":
-				idCmd = commands[0]
+				idCmd = &commands[0]
 				commands = commands[1:]
 			case "FROM":
-				fromCmd = commands[0]
+				fromCmd = &commands[0]
 				commands = commands[1:]
 			default:
 				done = true
@@ -35,15 +35,15 @@ func ReadMetadata(commands_in [][]string) (id, tag, name, version, baseName stri
 		return
 	}
 
-	if len(idCmd) >= 2 {
-		name = idCmd[1]
+	if len(idCmd.Args) >= 2 {
+		name = idCmd.Args[1]
 	} else {
-		err = errors.New("ID requires at least one argument.")
+		err = idCmd.Errorf(0, "ID requires at least one argument.")
 		return
 	}
 
-	if len(idCmd) >= 3 {
-		version = idCmd[2]
+	if len(idCmd.Args) >= 3 {
+		version = idCmd.Args[2]
 	}
 
 	// Systemd allows only 3 special characters in machine names: ".", "-", "_".
@@ -59,20 +59,25 @@ func ReadMetadata(commands_in [][]string) (id, tag, name, version, baseName stri
 	id = tag + "-" + strconv.FormatInt(time.Now().UnixNano(), 16)
 
 	if fromCmd != nil {
-		if len(fromCmd) >= 2 {
-			baseName = fromCmd[1]
+		if len(fromCmd.Args) >= 2 {
+			baseName = fromCmd.Args[1]
 		} else {
-			err = errors.New("FROM requires at least one argument.")
+			err = fromCmd.Errorf(0, "FROM requires at least one argument.")
 			return
 		}
 
-		baseSources = fromCmd[2:]
+		baseSources = fromCmd.Args[2:]
 	}
 
 	return
 }
 
-func Build(ictl *imagectl.ImageCtl, directory, tag string, writer io.Writer) (image imagectl.Image, ret_tag string, ok bool) {
+type BuildOptions struct {
+	NoCache bool // Build everything in a single image, without creating or reusing cached layers.
+	BuildArgs map[string]string // Values of the ARG variables.
+}
+
+func Build(ictl *imagectl.ImageCtl, directory, tag string, opts BuildOptions, writer io.Writer) (image imagectl.Image, ret_tag string, ok bool) {
 	EnsureSirenDirExists()
 
 	defer func(){
@@ -89,69 +94,113 @@ func Build(ictl *imagectl.ImageCtl, directory, tag string, writer io.Writer) (im
 		task.Require(err)
 	}()
 
-	var commands [][]string
+	var commands []Instruction
+	var buildArgs map[string]string
+	var warnings []error
 	func(){
 		task := NewTask(writer, "Parsing Sirenfile"); defer task.Finish()
 		var err error
-		commands, err = ParseSirenfile(string(sirenfile))
+		commands, err = ParseSirenfile(directory + "/Sirenfile", string(sirenfile))
+		task.Require(err)
+		commands, err = ResolveIncludes(directory, commands, task)
+		task.Require(err)
+		commands, buildArgs, warnings, err = expandInstructions(commands, opts.BuildArgs)
 		task.Require(err)
 	}()
 
-	var id, baseName string
+	func(){
+		task := NewTask(writer, "Checking Sirenfile"); defer task.Finish()
+		problems := append(warnings, Lint(directory, commands)...)
+		if tag != "" && tag != "-" && !imagectl.IsValidName(tag) {
+			problems = append(problems, errors.New("Invalid tag: " + tag))
+		}
+		errs := 0
+		for _, problem := range problems {
+			if IsWarning(problem) {
+				fmt.Fprintln(task, "WARNING: " + problem.Error())
+				continue
+			}
+			fmt.Fprintln(task, "ERROR: " + problem.Error())
+			errs++
+		}
+		task.Assert(errs == 0, errors.New(strconv.Itoa(errs) + " problems found."))
+	}()
+
+	stages, commands := SplitStages(commands)
+
+	var id, name, version, baseName string
 	var baseSources []string
 	//ret tag
 	func(){
 		task := NewTask(writer, "Reading metadata"); defer task.Finish()
 		var tag2 string
 		var err error
-		id, tag2, _, _, baseName, baseSources, commands, err = ReadMetadata(commands)
+		id, tag2, name, version, baseName, baseSources, commands, err = ReadMetadata(commands)
 		if tag == "" {
 			tag = tag2
 		}
 		task.Require(err)
 	}()
 
-	var base imagectl.Image
-	if baseName != "" {
-		func(){
-			task := NewTask(writer, "Accessing the base image: " + baseName); defer task.Finish()
-
-			var err error
-			if base, err = ictl.GetImage(baseName); err != nil {
-				for _, source := range baseSources {
-					var ok bool
-					func(){
-						task := NewTask(task, "Pulling the base image: " + source); defer task.Finish()
-						base, _, ok = Pull(ictl, source, baseName, task)
-					}()
-					if ok {
-						break
-					}
-				}
-			}
+	stageImages := map[string]imagectl.Image{}
+	temporary := []imagectl.Image{}
+	defer func(){
+		for _, image := range temporary {
+			NewTask(writer, "Removing the stage image: " + image.Name()).RequireAndFinish(image.Remove())
+		}
+	}()
 
-			if base == nil {
-				task.Require(errors.New("Base image does not exist."))
-			}
-		}()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 16)
+	for _, stage := range stages {
+		stageBase := accessBaseImage(ictl, stage.BaseName, stage.BaseSources, opts, writer)
+
+		b := NewBuildContext(nil, directory, stageBase)
+		b.ImageCtl, b.Stages = ictl, stageImages
+		b.Name, b.Version, b.Args = name, version, buildArgs
+
+		var image imagectl.Image
+		if opts.NoCache {
+			image = createImage(ictl, stageImageName(stage.Name, suffix), stageBase, writer)
+			temporary = append(temporary, image)
+			b.runCommands(image, stage.Commands, "Building the stage: " + stage.Name, writer)
+		} else {
+			image = b.runCachedCommands(ictl, stageBase, stage.Commands, "Building the stage: " + stage.Name, writer)
+		}
+		stageImages[stage.Name] = image
 	}
 
-	//ret image
-	func(){
-		task := NewTask(writer, "Creating an image: " + id); defer task.Finish()
-		var err error
-		image, err = ictl.CreateImage(id, base)
-		task.Require(err)
-	}()
+	base := accessBaseImage(ictl, baseName, baseSources, opts, writer)
+
+	b := NewBuildContext(nil, directory, base)
+	b.ImageCtl, b.Stages = ictl, stageImages
+	b.Name, b.Version, b.Args = name, version, buildArgs
+
+	if opts.NoCache {
+		image = createImage(ictl, id, base, writer)
+		b.runCommands(image, commands, "Building the image", writer)
+	} else {
+		top := b.runCachedCommands(ictl, base, commands, "Building the image", writer)
+		image = createImage(ictl, id, top, writer)
+	}
+
+	b.Image = image
 
 	func(){
-		task := NewTask(writer, "Building the image"); defer task.Finish()
-		b := BuildContext{task, image, directory}
-		for _, cmd := range commands {
-			b.SubtaskExec(cmd)
+		task := NewTask(writer, "Writing the environment"); defer task.Finish()
+		task.Require(b.WriteEnvironment())
+		if l, ok := image.(*imagectl.LayeredImage); ok {
+			task.Require(l.SetEnvironment(b.Env))
 		}
 	}()
 
+	if len(b.Labels) > 0 {
+		NewTask(writer, "Labeling").RequireAndFinish(imagectl.AddLabels(image, b.Labels))
+	}
+
+	if !b.Nspawn.Empty() {
+		NewTask(writer, "Writing the nspawn settings").RequireAndFinish(imagectl.SetNspawnSettings(image, b.Nspawn))
+	}
+
 	NewTask(writer, "Cleaning up the container").RequireAndFinish(moveSystemdConfigToUsr(image))
 	NewTask(writer, "Unmounting").RequireAndFinish(image.SetReady(false))
 
@@ -174,6 +223,64 @@ func Build(ictl *imagectl.ImageCtl, directory, tag string, writer io.Writer) (im
 	return image, tag, true
 }
 
+// accessBaseImage returns the base image, pulling it from the first working source if it does not exist.
+// Returns nil if there is no base image.
+func accessBaseImage(ictl *imagectl.ImageCtl, baseName string, baseSources []string, opts BuildOptions, writer io.Writer) (base imagectl.Image) {
+	if baseName == "" {
+		return nil
+	}
+
+	task := NewTask(writer, "Accessing the base image: " + baseName); defer task.Finish()
+
+	var err error
+	if base, err = ictl.GetImage(baseName); err != nil {
+		for _, source := range baseSources {
+			var ok bool
+			func(){
+				task := NewTask(task, "Pulling the base image: " + source); defer task.Finish()
+				baseOpts := opts
+				baseOpts.BuildArgs = nil // They belong to our Sirenfile, not to the base image's one.
+				base, _, ok = Pull(ictl, source, baseName, baseOpts, task)
+			}()
+			if ok {
+				break
+			}
+		}
+	}
+
+	if base == nil {
+		task.Require(errors.New("Base image does not exist."))
+	}
+	return base
+}
+
+func createImage(ictl *imagectl.ImageCtl, id string, base imagectl.Image, writer io.Writer) imagectl.Image {
+	task := NewTask(writer, "Creating an image: " + id); defer task.Finish()
+	image, err := ictl.CreateImage(id, base)
+	task.Require(err)
+	return image
+}
+
+// runCommands executes the commands in the image.
+func (b *BuildContext) runCommands(image imagectl.Image, commands []Instruction, description string, writer io.Writer) {
+	task := NewTask(writer, description); defer task.Finish()
+	b.Task, b.Image = task, image
+	for _, cmd := range commands {
+		b.SubtaskExec(cmd)
+	}
+}
+
+// runCachedCommands executes the commands in cached layers on top of base. Returns the topmost layer.
+func (b *BuildContext) runCachedCommands(ictl *imagectl.ImageCtl, base imagectl.Image, commands []Instruction, description string, writer io.Writer) imagectl.Image {
+	task := NewTask(writer, description); defer task.Finish()
+	b.Task = task
+	top := base
+	for _, cmd := range commands {
+		top = b.CachedExec(ictl, top, cmd)
+	}
+	return top
+}
+
 func moveSystemdConfigToUsr(i imagectl.Image) error {
 	cmd := i.Command("mkdir", "-p", "/etc/systemd/system", "/etc/systemd/user", "/etc/systemd/network")
 	if out, err := cmd.CombinedOutput(); err != nil {
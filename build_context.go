@@ -1,71 +1,160 @@
-package main
+package siren
 
 import (
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/coreos/go-systemd/unit"
 	"github.com/LEW21/siren/imagectl"
+	"github.com/coreos/go-systemd/unit"
 )
 
 type BuildContext struct {
 	Task *Task
 	Image imagectl.Image
 	Directory string
+
+	Name, Version string // From ID.
+	Args map[string]string // Values of the build arguments.
+
+	ImageCtl *imagectl.ImageCtl // Used to find the images of COPY --from. nil - only the stages can be used.
+	Stages map[string]imagectl.Image // Images of the already built stages. nil for empty stages.
+
+	Env []string // KEY=VALUE pairs set with ENV, passed to every RUN.
+	WorkDir string // Set with WORKDIR. Relative paths in the image are resolved against it.
+	User, Group string // Set with USER.
+	Shell []string // Set with SHELL. Used to run RUN <<EOF scripts.
+	Caches []string // Set with CACHE. Build caches bound to these directories during every RUN.
+	Labels map[string]string // Set with LABEL. Stored in the image metadata.
+	Nspawn imagectl.NspawnSettings // Set with PORT, BIND, NETWORK_ZONE and CAPABILITY. Stored in the image metadata.
 }
 
-func (b BuildContext) RealPath(path string) string {
-	if path[0] == '/' {
-		panic("BuildContext.RealPath: The argument has to be a relative path.")
+func NewBuildContext(task *Task, directory string, base imagectl.Image) *BuildContext {
+	b := &BuildContext{task, nil, directory, "", "", nil, nil, nil, nil, "/", "", "", []string{"/bin/sh", "-e"}, nil, map[string]string{}, imagectl.NspawnSettings{}}
+
+	// Inherit the environment, the labels and the nspawn settings of the base image.
+	if l, ok := base.(*imagectl.LayeredImage); ok {
+		b.Env = append(b.Env, l.Environment()...)
+		for key, value := range l.Labels() {
+			b.Labels[key] = value
+		}
+		b.Nspawn = b.Nspawn.Merge(l.NspawnSettings())
 	}
-	return b.Directory + "/" + path
+
+	return b
 }
 
-func (b *BuildContext) Run(name string, arg ...string) error {
-	return b.Task.RunCmd(b.Image.Command(name, arg...))
+// RealPath returns the real path of a file in the build directory. Paths leading outside of it
+// (also through symlinks in the parent directories) are refused.
+func (b BuildContext) RealPath(path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", errors.New("Source paths have to be relative to the build directory: " + path)
+	}
+	return resolveInside(b.Directory, path)
 }
 
-func (b *BuildContext) Copy(arg ...string) error {
-	dst := arg[len(arg)-1]
-	src := arg[:len(arg)-1]
+// ResolvePath returns the real path of a path inside the image, resolving it against WORKDIR.
+// Symlinks are followed like in a chroot - the result is always inside the image.
+func (b BuildContext) ResolvePath(p string) (string, error) {
+	return imagectl.ResolvePath(b.Image.Path(), b.ImagePath(p))
+}
 
-	// TODO? add support for wildcards
+// ImagePath makes a path inside the image absolute, resolving it against WORKDIR.
+func (b BuildContext) ImagePath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
 
-	args := []string{"-R"}
-	for _, srcdir := range src {
-		args = append(args, b.RealPath(srcdir))
+	abs := path.Join(b.WorkDir, p)
+	if strings.HasSuffix(p, "/") {
+		abs += "/"
 	}
+	return abs
+}
 
-	args = append(args, b.Image.RealPath(dst))
-	return b.Task.RunCommand("cp", args...)
+// Run runs the command of RUN in the image - as USER, in WORKDIR.
+func (b *BuildContext) Run(name string, arg ...string) error {
+	opts := imagectl.CommandOptions{Env: b.Env, WorkDir: b.WorkDir, User: b.User, Group: b.Group}
+	for _, dir := range b.Caches {
+		bind, err := cacheBind(unit.UnitNamePathEscape(dir), dir)
+		if err != nil {
+			return err
+		}
+		opts.Binds = append(opts.Binds, bind)
+	}
+	return b.Task.RunCmd(imagectl.ImageCommandWithOptions(b.Image, opts, name, arg...))
+}
+
+// cacheBind creates the build cache /var/lib/siren/cache/NAME, and returns the bind of it to dir in the image.
+// Build caches are shared by all the builds, and not stored in the layers.
+func cacheBind(name, dir string) (string, error) {
+	cacheDir := "/var/lib/siren/cache/" + name
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	return cacheDir + ":" + dir, nil
 }
 
-func (b *BuildContext) download(uri *url.URL) (res *url.URL, err error) {
-	res = &url.URL{}
+// rootCommand returns a command run in the image by the instructions other than RUN - as root, in "/",
+// regardless of USER and WORKDIR.
+func (b *BuildContext) rootCommand(name string, arg ...string) *exec.Cmd {
+	opts := imagectl.CommandOptions{Env: b.Env, WorkDir: "/"}
+	return imagectl.ImageCommandWithOptions(b.Image, opts, name, arg...)
+}
 
-	res.Fragment = uri.Fragment
-	uri.Fragment = ""
+// RunScript handles "RUN [INTERPRETER...] <<EOF". The script is written into the image,
+// and executed with the given interpreter, or with SHELL if there is none.
+func (b *BuildContext) RunScript(interpreter []string, script string) error {
+	if len(interpreter) == 0 {
+		interpreter = b.Shell
+	}
 
-	res.Path = "/var/lib/siren/" + unit.UnitNameEscape(uri.String())
+	tmp, err := b.ResolvePath("/var/tmp")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 01777); err != nil {
+		return err
+	}
 
-	{
-		_, err := os.Stat(res.Path)
-		if err == nil {
-			return res, nil
-		}
+	// Not in /tmp - systemd-nspawn mounts a tmpfs there.
+	scriptName := "siren-script-" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	if err := ioutil.WriteFile(filepath.Join(tmp, scriptName), []byte(script), 0755); err != nil {
+		return err
 	}
+	defer os.Remove(filepath.Join(tmp, scriptName))
+
+	scriptPath := "/var/tmp/" + scriptName
 
-	err = b.Task.RunCommand("wget", uri.String(), "-O", res.Path, "--progress=dot:mega")
+	return b.Run(interpreter[0], append(interpreter[1:], scriptPath)...)
+}
+
+// download returns the path of the cached copy of the http(s) file.
+func (b *BuildContext) download(uri *url.URL, checksum string) (string, error) {
+	return NewDownloader("/var/lib/siren").Download(uri.String(), checksum, b.Task)
+}
 
-	return res, err
+// remoteVersion revalidates the cached copy of the http(s) file (downloading it if it changed), and returns
+// its version, for the cache key. Errors are returned as the version - Exec reports them.
+func (b *BuildContext) remoteVersion(uri *url.URL, checksum string) string {
+	version, err := NewDownloader("/var/lib/siren").Version(uri.String(), checksum, b.Task)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return version
 }
 
+// Untar handles "UNTAR [--checksum=sha256:HEX] TARBALL[#SUBDIR][&sha256=HEX]... DST".
 func (b *BuildContext) Untar(arg ...string) error {
+	opts, arg := SplitOptions(arg)
 	dst := arg[len(arg)-1]
 	src := arg[:len(arg)-1]
 
@@ -75,24 +164,35 @@ func (b *BuildContext) Untar(arg ...string) error {
 			return err
 		}
 
+		subdir, checksum := splitFragment(u.Fragment)
+		if checksum == "" {
+			checksum = opts.Get("checksum")
+		}
+		u.Fragment = ""
+
+		path := ""
 		if u.Scheme == "http" || u.Scheme == "https" {
-			var err error
-			u, err = b.download(u)
-			if err != nil {
+			if path, err = b.download(u, checksum); err != nil {
 				return err
 			}
 		} else {
-			u.Path = b.RealPath(u.Path)
+			if path, err = b.RealPath(u.Path); err != nil {
+				return err
+			}
+			if err := VerifyChecksum(path, checksum); err != nil {
+				return err
+			}
 		}
 
-		args := []string{"-xf", u.Path, "-C", b.Image.RealPath(dst)}
-
-		if u.Fragment != "" {
-			strip_components := 1 + strings.Count(u.Fragment, "/")
-			args = append(args, u.Fragment, "--strip-components", strconv.Itoa(strip_components))
+		realDst, err := b.ResolvePath(dst)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(realDst, 0755); err != nil {
+			return err
 		}
 
-		if err := b.Task.RunCommand("tar", args...); err != nil {
+		if err := ExtractTarball(path, b.Image.Path(), b.ImagePath(dst), subdir); err != nil {
 			return err
 		}
 	}
@@ -100,67 +200,236 @@ func (b *BuildContext) Untar(arg ...string) error {
 	return nil
 }
 
-func (b *BuildContext) Set(name, value string) error {
-	return ioutil.WriteFile(b.Image.RealPath(name), []byte(value), 0644)
+// DownloadFile handles "DOWNLOAD [--mode=MODE] [--sha256=HEX] URL DST".
+// DST is a directory if it ends with "/" or already exists as a directory - the file keeps its name from the URL.
+func (b *BuildContext) DownloadFile(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+
+	u, err := url.Parse(arg[0])
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Only http and https URLs can be downloaded: " + arg[0])
+	}
+
+	_, checksum := splitFragment(u.Fragment)
+	if sha := opts.Get("sha256"); sha != "" {
+		checksum = sha
+	}
+	u.Fragment = ""
+
+	mode := os.FileMode(0644)
+	if m := opts.Get("mode"); m != "" {
+		if mode, err = ParseMode(m); err != nil {
+			return err
+		}
+	}
+
+	dst := b.ImagePath(arg[1])
+	realDst, err := b.ResolvePath(dst)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(realDst); strings.HasSuffix(dst, "/") || err == nil && fi.IsDir() {
+		name := path.Base(u.Path)
+		if name == "/" || name == "." {
+			return errors.New("Cannot name the file after the URL - DST has to be a file path: " + arg[1])
+		}
+		if realDst, err = b.ResolvePath(path.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+
+	cached, err := b.download(u, checksum)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(realDst), 0755); err != nil {
+		return err
+	}
+	return copyFile(cached, realDst, mode)
+}
+
+// copyFile copies a regular file, replacing dst.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	os.Remove(dst)
+	out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Chmod, not the umask-affected OpenFile mode - and it handles the setuid bits.
+	return os.Chmod(dst, mode)
 }
 
-func unitName(name string) string {
-	if strings.HasSuffix(name, ".service") || strings.HasSuffix(name, ".socket") {
-		return name
+func (b *BuildContext) SetWorkDir(dir string) error {
+	b.WorkDir = b.ImagePath(dir)
+	realDir, err := b.ResolvePath(b.WorkDir)
+	if err != nil {
+		return err
 	}
-	return name + ".service"
+	return os.MkdirAll(realDir, 0755)
 }
 
-func (b *BuildContext) addUnit(name string) error {
-	return b.Copy(name, "/usr/lib/systemd/system/")
+// SetUser handles "USER name[:group]".
+func (b *BuildContext) SetUser(user string) error {
+	b.User, b.Group = user, ""
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		b.User, b.Group = user[:colon], user[colon+1:]
+	}
+
+	if b.User == "" {
+		return errors.New("Invalid user: " + user)
+	}
+	if b.User == "root" && b.Group == "" {
+		b.User = ""
+	}
+	return nil
 }
 
-func (b *BuildContext) AddUnit(name string) error {
-	return b.addUnit(unitName(name))
+// SetLabels handles "LABEL KEY=VALUE...".
+func (b *BuildContext) SetLabels(arg ...string) error {
+	for _, label := range arg {
+		key, value, err := imagectl.ParseLabel(label)
+		if err != nil {
+			return err
+		}
+		b.Labels[key] = value
+	}
+	return nil
 }
 
-func (b *BuildContext) Enable(name string) error {
-	name = unitName(name)
-	if err := b.addUnit(name); err != nil {
-		fmt.Fprintln(b.Task, "Warning: " + name + " file not found.")
+// AddCaches handles "CACHE DIR...".
+func (b *BuildContext) AddCaches(arg ...string) error {
+	for _, dir := range arg {
+		dir = path.Clean(b.ImagePath(dir))
+		if dir == "/" {
+			return errors.New("The whole image can't be a cache.")
+		}
+		b.Caches = append(b.Caches, dir)
 	}
-	return b.Run("systemctl", "enable", name)
+	return nil
 }
 
-var ErrNotEnoughArguments = errors.New("not enough arguments")
+// AddPorts handles "PORT [PROTO:]HOST_PORT[:CONTAINER_PORT]...".
+func (b *BuildContext) AddPorts(arg ...string) error {
+	for _, port := range arg {
+		if err := imagectl.ParsePort(port); err != nil {
+			return err
+		}
+	}
+	b.Nspawn = b.Nspawn.Merge(imagectl.NspawnSettings{Ports: arg})
+	return nil
+}
 
-// Don't error out when we get too many arguments - we can use them to extend the commands in the future.
+// AddBind handles "BIND [--ro] SOURCE [DEST]".
+func (b *BuildContext) AddBind(arg ...string) error {
+	opts, arg := SplitOptions(arg)
 
-func (b *BuildContext) Exec(cmd []string) error {
-	command := cmd[0]
-	arg := cmd[1:]
+	dest := ""
+	if len(arg) >= 2 {
+		dest = arg[1]
+	}
+	bind, err := imagectl.ParseBind(arg[0], dest)
+	if err != nil {
+		return err
+	}
 
-	switch (command) {
-		case "RUN":
-			return b.Run(arg[0], arg[1:]...)
+	if opts.Has("ro") {
+		b.Nspawn = b.Nspawn.Merge(imagectl.NspawnSettings{ReadOnlyBinds: []string{bind}})
+	} else {
+		b.Nspawn = b.Nspawn.Merge(imagectl.NspawnSettings{Binds: []string{bind}})
+	}
+	return nil
+}
 
-		case "COPY":
-			return b.Copy(arg...)
+// SetNetworkZone handles "NETWORK_ZONE NAME".
+func (b *BuildContext) SetNetworkZone(zone string) error {
+	if !imagectl.IsValidZone(zone) {
+		return errors.New("Invalid network zone: " + zone)
+	}
+	b.Nspawn.Zone = zone
+	return nil
+}
 
-		case "UNTAR":
-			return b.Untar(arg...)
+// AddCapabilities handles "CAPABILITY CAP...".
+func (b *BuildContext) AddCapabilities(arg ...string) error {
+	for _, capability := range arg {
+		if !imagectl.IsValidCapability(capability) {
+			return errors.New("Invalid capability: " + capability)
+		}
+	}
+	b.Nspawn = b.Nspawn.Merge(imagectl.NspawnSettings{Capabilities: arg})
+	return nil
+}
+
+// Set handles "SET [--mode=MODE] PATH VALUE".
+func (b *BuildContext) Set(arg ...string) error {
+	opts, arg := splitTrailingOptions(arg, 2)
+	realPath, err := b.ResolvePath(arg[0])
+	if err != nil {
+		return err
+	}
+	return writeFile(realPath, []byte(arg[1]), opts.Get("mode"), false)
+}
 
-		case "SET":
-			return b.Set(arg[0], arg[1])
+// Append handles "APPEND [--mode=MODE] PATH VALUE".
+func (b *BuildContext) Append(arg ...string) error {
+	opts, arg := splitTrailingOptions(arg, 2)
+	realPath, err := b.ResolvePath(arg[0])
+	if err != nil {
+		return err
+	}
+	line, err := appendLine(realPath, arg[1])
+	if err != nil {
+		return err
+	}
+	return writeFile(realPath, []byte(line), opts.Get("mode"), true)
+}
 
-		case "ADD_UNIT":
-			return b.AddUnit(arg[0])
+var ErrNotEnoughArguments = errors.New("not enough arguments")
 
-		case "ENABLE":
-			return b.Enable(arg[0])
+// Don't error out when we get too many arguments - we can use them to extend the commands in the future.
 
-		default:
-			return errors.New("Unknown command: " + command)
+func (b *BuildContext) Exec(cmd Instruction) error {
+	def, ok := LookupInstruction(cmd.Args[0])
+	if !ok {
+		return errors.New("Unknown command: " + cmd.Args[0])
+	}
+	if def.Exec == nil {
+		return errors.New(cmd.Args[0] + " can be used only at the beginning of the Sirenfile.")
+	}
+	if err := def.checkOptions(cmd); err != nil {
+		return err
 	}
+	if def.positionalArgs(cmd) < def.MinArgs {
+		return ErrNotEnoughArguments
+	}
+	return def.Exec(b, cmd)
+}
+
+func Describe(cmd Instruction) string {
+	return cmd.Args[0] + " (" + strings.Join(cmd.Args[1:], ") (") + ")"
 }
 
-func (b *BuildContext) SubtaskExec(cmd []string) {
-	subtask := NewTask(b.Task, cmd[0] + " (" + strings.Join(cmd[1:], ") (") + ")"); defer subtask.Finish()
+func (b *BuildContext) SubtaskExec(cmd Instruction) {
+	subtask := NewTask(b.Task, Describe(cmd)); defer subtask.Finish()
 	maintask := b.Task
 	b.Task = subtask; defer func(){b.Task = maintask}()
 
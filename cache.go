@@ -0,0 +1,214 @@
+package siren
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// Every instruction is built in its own frozen layered image, named after a hash of
+// the layer below it, the instruction itself, the build state (eg. the environment, and the State of the instruction),
+// the content of the files it reads from the build directory, and the images it copies from.
+// If such an image already exists, it is reused as is.
+const cachedLayerPrefix = "siren-cache-"
+
+func (b *BuildContext) CacheKey(parent imagectl.Image, cmd Instruction) (string, error) {
+	h := sha256.New()
+
+	if parent != nil {
+		io.WriteString(h, parent.Name())
+	}
+	h.Write([]byte{0})
+
+	for _, kv := range b.Env {
+		io.WriteString(h, kv)
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{0})
+
+	fmt.Fprintf(h, "%v\x00%v\x00%v\x00", b.WorkDir, b.User, b.Group)
+
+	for _, arg := range b.Shell {
+		io.WriteString(h, arg)
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{0})
+
+	for _, dir := range b.Caches {
+		io.WriteString(h, dir)
+		h.Write([]byte{0})
+	}
+	h.Write([]byte{0})
+
+	for _, arg := range cmd.Args {
+		io.WriteString(h, arg)
+		h.Write([]byte{0})
+	}
+	io.WriteString(h, cmd.Body)
+	h.Write([]byte{0})
+
+	io.WriteString(h, b.state(cmd))
+	h.Write([]byte{0})
+
+	for _, input := range b.inputs(cmd) {
+		// The name too - hashPath hashes the paths relative to the input.
+		io.WriteString(h, input)
+		h.Write([]byte{0})
+
+		realPath, err := b.RealPath(input)
+		if err != nil {
+			return "", err
+		}
+		if err := hashPath(h, realPath); err != nil {
+			return "", err
+		}
+	}
+
+	for _, name := range b.images(cmd) {
+		image, err := b.LookupImage(name)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, image.Name())
+		h.Write([]byte{0})
+	}
+
+	// Machine names are limited to 64 characters - 128 bits are enough.
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// state returns the State of the instruction.
+func (b *BuildContext) state(cmd Instruction) string {
+	def, ok := LookupInstruction(cmd.Args[0])
+	if !ok || def.State == nil || def.positionalArgs(cmd) < def.MinArgs {
+		return ""
+	}
+	return def.State(b, cmd)
+}
+
+// inputs returns the build directory paths read by the instruction.
+func (b *BuildContext) inputs(cmd Instruction) []string {
+	def, ok := LookupInstruction(cmd.Args[0])
+	if !ok || def.Inputs == nil || def.positionalArgs(cmd) < def.MinArgs {
+		return nil
+	}
+	return def.Inputs(b, cmd)
+}
+
+// images returns the names of the images (or stages) read by the instruction.
+func (b *BuildContext) images(cmd Instruction) []string {
+	def, ok := LookupInstruction(cmd.Args[0])
+	if !ok || def.Images == nil || def.positionalArgs(cmd) < def.MinArgs {
+		return nil
+	}
+	return def.Images(b, cmd)
+}
+
+func hashPath(h hash.Hash, root string) error {
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		io.WriteString(h, "missing")
+		h.Write([]byte{0})
+		return nil
+	}
+
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		fmt.Fprintf(h, "%v\x00%v\x00", rel, fi.Mode())
+
+		switch {
+			case fi.Mode().IsRegular():
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := io.Copy(h, f); err != nil {
+					return err
+				}
+
+			case fi.Mode() & os.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				io.WriteString(h, target)
+		}
+		h.Write([]byte{0})
+		return nil
+	})
+}
+
+// CachedExec executes cmd in a new layer on top of parent, and freezes it.
+// Returns the new layer, or the existing one if cmd has been built on top of parent before.
+func (b *BuildContext) CachedExec(ictl *imagectl.ImageCtl, parent imagectl.Image, cmd Instruction) imagectl.Image {
+	def, _ := LookupInstruction(cmd.Args[0])
+	if def.StateOnly {
+		b.SubtaskExec(cmd)
+		return parent
+	}
+
+	key, err := b.CacheKey(parent, cmd)
+	b.Task.Require(err)
+	name := cachedLayerPrefix + key
+
+	if layer, err := ictl.GetImage(name); err == nil {
+		if layer.ReadOnly() {
+			b.reuseLayer(cmd)
+			return layer
+		}
+
+		// Leftover of an interrupted build.
+		b.Task.Require(layer.Remove())
+	}
+
+	subtask := NewTask(b.Task, Describe(cmd)); defer subtask.Finish()
+	maintask := b.Task
+	b.Task = subtask; defer func(){b.Task = maintask}()
+
+	layer, err := ictl.CreateImage(name, parent)
+	subtask.Require(err)
+
+	defer func(){
+		if r := recover(); r != nil {
+			layer.Remove()
+			panic(r)
+		}
+	}()
+
+	b.Image = layer
+	subtask.Require(b.Exec(cmd))
+	subtask.Require(commitLayer(layer, subtask))
+	return layer
+}
+
+// reuseLayer applies the changes of the instruction to the BuildContext, when its layer is taken from the cache.
+func (b *BuildContext) reuseLayer(cmd Instruction) {
+	fmt.Fprintln(b.Task, Describe(cmd) + "... cached")
+	if def, _ := LookupInstruction(cmd.Args[0]); def.UpdateState != nil {
+		def.UpdateState(b, cmd.Args[1:])
+	}
+}
+
+func commitLayer(layer imagectl.Image, task *Task) error {
+	if err := layer.SetReady(false); err != nil {
+		return err
+	}
+
+	layer.Optimize(func(string){}, func(err error){fmt.Fprintln(task, err)})
+
+	if err := layer.SetReadOnly(true); err != nil {
+		return err
+	}
+
+	return layer.SetReady(true)
+}
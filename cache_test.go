@@ -0,0 +1,97 @@
+package siren
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func cacheKey(t *testing.T, b *BuildContext, cmd Instruction) string {
+	key, err := b.CacheKey(nil, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCacheKeyCopyInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewBuildContext(nil, dir, nil)
+	copyConf := Instruction{Args: []string{"COPY", "*.conf", "/etc/"}}
+	ioutil.WriteFile(filepath.Join(dir, "a.conf"), []byte("same"), 0644)
+	key := cacheKey(t, b, copyConf)
+
+	os.Rename(filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf"))
+	renamed := cacheKey(t, b, copyConf)
+	if renamed == key {
+		t.Errorf("Renaming a matched file did not change the key")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "c.conf"), []byte("same"), 0644)
+	if cacheKey(t, b, copyConf) == renamed {
+		t.Errorf("Adding a match with the same content did not change the key")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.conf"), []byte("1"), 0644)
+
+	run := Instruction{Args: []string{"RUN", "sh", "<<EOF"}, Body: "make\n"}
+	copyConf := Instruction{Args: []string{"COPY", "app.conf", "/etc/"}}
+
+	base := NewBuildContext(nil, dir, nil)
+	runKey, copyKey := cacheKey(t, base, run), cacheKey(t, base, copyConf)
+	if again := cacheKey(t, NewBuildContext(nil, dir, nil), run); again != runKey {
+		t.Errorf("CacheKey() is not stable: %v != %v", again, runKey)
+	}
+
+	changes := map[string]func(b *BuildContext){
+		"Env": func(b *BuildContext) { b.SetEnv("LANG=C") },
+		"WorkDir": func(b *BuildContext) { b.WorkDir = "/srv" },
+		"User": func(b *BuildContext) { b.SetUser("app") },
+		"Group": func(b *BuildContext) { b.SetUser("root:wheel") },
+		"Shell": func(b *BuildContext) { b.Shell = []string{"/bin/bash", "-e"} },
+		"Caches": func(b *BuildContext) { b.AddCaches("/var/cache/pip") },
+	}
+	for name, change := range changes {
+		b := NewBuildContext(nil, dir, nil)
+		change(b)
+		if cacheKey(t, b, run) == runKey {
+			t.Errorf("Changing %v did not change the key", name)
+		}
+	}
+
+	body := run
+	body.Body = "make install\n"
+	if cacheKey(t, base, body) == runKey {
+		t.Errorf("Changing the heredoc did not change the key")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "app.conf"), []byte("2"), 0644)
+	if cacheKey(t, base, copyConf) == copyKey {
+		t.Errorf("Changing the content of an input did not change the key")
+	}
+	if cacheKey(t, base, run) != runKey {
+		t.Errorf("Changing a file RUN does not read changed its key")
+	}
+}
+
+func TestReuseLayer(t *testing.T) {
+	b := NewBuildContext(NewTask(&bytes.Buffer{}, "test"), "", nil)
+	b.reuseLayer(Instruction{Args: []string{"WORKDIR", "/srv/app"}})
+	if b.WorkDir != "/srv/app" {
+		t.Errorf("WorkDir after a cached WORKDIR == %q, want %q", b.WorkDir, "/srv/app")
+	}
+}
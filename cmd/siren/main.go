@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/LEW21/siren"
 	"github.com/LEW21/siren/imagectl"
 )
 
@@ -11,7 +12,7 @@ func main() {
 	args := os.Args[1:]
 
 	allCommands := []imagectl.CommandGroup{
-		{"Siren", Commands},
+		{"Siren", siren.Commands},
 		{"Image", imagectl.Commands},
 	}
 
@@ -1,16 +1,38 @@
-package main
+package siren
 
 import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/LEW21/siren/imagectl"
 )
 
-var Commands = []imagectl.Command{CmdBuild, CmdPull}
+var Commands = []imagectl.Command{CmdBuild, CmdPull, CmdLint, CmdHelp}
 
-var CmdBuild = imagectl.Command{nil, "build", []string{"DIR_PATH"}, []string{"TAG"}, "Build an image from a Sirenfile", cmdBuild}
+var buildOptions BuildOptions
+
+var buildOptionList = []imagectl.Option{
+	{"no-cache", "", "Do not use cached layers", func(string){buildOptions.NoCache = true}},
+	{"build-arg", "NAME=VALUE", "Set a build argument declared with ARG", setBuildArg},
+}
+
+func setBuildArg(arg string) {
+	if buildOptions.BuildArgs == nil {
+		buildOptions.BuildArgs = map[string]string{}
+	}
+
+	if eq := strings.Index(arg, "="); eq >= 0 {
+		buildOptions.BuildArgs[arg[:eq]] = arg[eq+1:]
+	} else {
+		// Like docker: --build-arg NAME takes the value from our environment.
+		buildOptions.BuildArgs[arg] = os.Getenv(arg)
+	}
+}
+
+var CmdBuild = imagectl.Command{nil, "build", []string{"DIR_PATH"}, []string{"TAG"}, "Build an image from a Sirenfile", cmdBuild, buildOptionList}
 func cmdBuild(args []string) int {
 	path := args[0]
 	tag := ""
@@ -28,7 +50,7 @@ func cmdBuild(args []string) int {
 		panic(err)
 	}
 
-	_, tag, ok := Build(ictl, path, tag, os.Stderr)
+	_, tag, ok := Build(ictl, path, tag, buildOptions, os.Stderr)
 	if !ok {
 		return 1
 	}
@@ -39,7 +61,7 @@ func cmdBuild(args []string) int {
 	return 0
 }
 
-var CmdPull = imagectl.Command{nil, "pull", []string{"URI"}, []string{"TAG"}, "Pull and build an image from a git repostory", cmdPull}
+var CmdPull = imagectl.Command{nil, "pull", []string{"URI"}, []string{"TAG"}, "Pull and build an image from a git repostory", cmdPull, buildOptionList}
 func cmdPull(args []string) int {
 	uri := args[0]
 	tag := ""
@@ -52,7 +74,7 @@ func cmdPull(args []string) int {
 		panic(err)
 	}
 
-	_, tag, ok := Pull(ictl, uri, tag, os.Stderr)
+	_, tag, ok := Pull(ictl, uri, tag, buildOptions, os.Stderr)
 	if !ok {
 		return 1
 	}
@@ -62,3 +84,58 @@ func cmdPull(args []string) int {
 	fmt.Println("Use 'siren create instance_name " + tag + "' to create a new, writable machine image using this image as a base.")
 	return 0
 }
+
+var CmdLint = imagectl.Command{nil, "lint", []string{"DIR_PATH"}, nil, "Check a Sirenfile for problems", cmdLint, []imagectl.Option{
+	{"build-arg", "NAME=VALUE", "Set a build argument declared with ARG", setBuildArg},
+}}
+func cmdLint(args []string) int {
+	path, err := filepath.Abs(args[0])
+	if err != nil {
+		panic(err)
+	}
+
+	errs, warnings := 0, 0
+	for _, problem := range LintSirenfile(path, buildOptions.BuildArgs, os.Stderr) {
+		if IsWarning(problem) {
+			fmt.Fprintln(os.Stderr, "Warning: " + problem.Error())
+			warnings++
+			continue
+		}
+		fmt.Fprintln(os.Stderr, problem)
+		errs++
+	}
+
+	if errs > 0 {
+		fmt.Println()
+		fmt.Println(strconv.Itoa(errs) + " problems found.")
+		return 1
+	}
+
+	if warnings > 0 {
+		fmt.Println()
+		fmt.Println("No problems found, " + strconv.Itoa(warnings) + " warnings.")
+		return 0
+	}
+	fmt.Println("No problems found.")
+	return 0
+}
+
+var CmdHelp = imagectl.Command{nil, "help", []string{"TOPIC"}, nil, "Show help on a topic (instructions)", cmdHelp, nil}
+func cmdHelp(args []string) int {
+	switch args[0] {
+		case "instructions":
+			fmt.Println("Sirenfile instructions:")
+			for _, def := range Instructions() {
+				fmt.Println()
+				fmt.Println("  " + def.Usage)
+				if def.Help != "" {
+					fmt.Println("      " + def.Help)
+				}
+			}
+			return 0
+
+		default:
+			fmt.Fprintln(os.Stderr, "Unknown help topic: " + args[0])
+			return 1
+	}
+}
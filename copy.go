@@ -0,0 +1,260 @@
+package siren
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// copyMatches returns the build directory files matched by each source pattern of COPY, for the cache key.
+// Patterns matching nothing are returned as they are, and fail in Copy. Nothing for COPY --from.
+func (b *BuildContext) copyMatches(cmd Instruction) [][]string {
+	opts, args := SplitOptions(cmd.Args[1:])
+	if opts.Has("from") {
+		return nil
+	}
+	res := [][]string{}
+	for _, pattern := range args[:len(args)-1] {
+		matches, err := Glob(b.Directory, pattern)
+		if err != nil || len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		res = append(res, matches)
+	}
+	return res
+}
+
+// Copy handles "COPY [--from=IMAGE] [--chown=USER[:GROUP] | --preserve-owner] [--chmod=MODE] SRC... DST".
+//
+// DST is a directory if it ends with "/" or already exists as a directory - the sources are copied into it.
+// Otherwise, it is the path of the copy. Multiple sources (also from wildcards) require a directory.
+//
+// With --from, the sources are paths inside the given stage or image, instead of the build directory.
+//
+// The copies keep the modes, xattrs (eg. file capabilities), hardlinks and holes of the sources.
+// They are owned by root, unless --chown or --preserve-owner is used.
+func (b *BuildContext) Copy(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	dst := b.ImagePath(arg[len(arg)-1])
+	patterns := arg[:len(arg)-1]
+
+	srcRoot, where := b.Directory, "the build directory"
+	realSource := b.RealPath
+	if from := opts.Get("from"); from != "" {
+		image, err := b.LookupImage(from)
+		if err != nil {
+			return err
+		}
+		srcRoot, where = image.Path(), from
+		realSource = func(s string) (string, error) {
+			return imagectl.ResolvePathNoFollow(image.Path(), s)
+		}
+	}
+
+	src := []string{}
+	for _, pattern := range patterns {
+		if srcRoot == b.Directory && path.IsAbs(pattern) {
+			return errors.New("Source paths have to be relative to the build directory: " + pattern)
+		}
+
+		matches, err := Glob(srcRoot, strings.TrimPrefix(pattern, "/"))
+		if err != nil || len(matches) == 0 {
+			return errors.New("No files in " + where + " match: " + pattern)
+		}
+		src = append(src, matches...)
+	}
+
+	realDst, err := b.ResolvePath(dst)
+	if err != nil {
+		return err
+	}
+
+	dstIsDir := strings.HasSuffix(dst, "/")
+	if fi, err := os.Stat(realDst); err == nil && fi.IsDir() {
+		dstIsDir = true
+	}
+
+	if len(src) > 1 && !dstIsDir {
+		return errors.New("Multiple files can be copied only to a directory - end the destination with \"/\": " + dst)
+	}
+
+	// One for all the sources - files hardlinked between them stay hardlinked.
+	copyOpts := CopyOptions{opts.Has("preserve-owner"), 0, 0, true, true, true, b.Image.Path(), map[[2]uint64]string{}}
+	if owner := opts.Get("chown"); owner != "" {
+		if copyOpts.PreserveOwner {
+			return errors.New("--chown and --preserve-owner can't be used together.")
+		}
+		var err error
+		if copyOpts.UID, copyOpts.GID, err = b.LookupOwner(owner); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(0)
+	if chmod := opts.Get("chmod"); chmod != "" {
+		var err error
+		if mode, err = ParseMode(chmod); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range src {
+		target := dst
+		if dstIsDir {
+			target = path.Join(dst, path.Base(s))
+		}
+		realTarget, err := b.ResolvePath(target)
+		if err != nil {
+			return err
+		}
+		realSrc, err := realSource(s)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(realTarget), 0755); err != nil {
+			return err
+		}
+
+		if err := CopyTree(realSrc, realTarget, copyOpts); err != nil {
+			return err
+		}
+
+		if err := chmodTree(realTarget, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseMode parses an octal mode, like chmod does.
+func ParseMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, errors.New("Invalid mode: " + mode + " (expected an octal number, eg. 0644)")
+	}
+	return os.FileMode(m & 0777) | unixModeBits(m), nil
+}
+
+// unixModeBits converts the setuid, setgid and sticky bits of a numeric mode to os.FileMode.
+func unixModeBits(m uint64) os.FileMode {
+	mode := os.FileMode(0)
+	if m & 04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m & 02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m & 01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// chmodTree changes the mode (if not 0) of the whole tree. Symlinks are skipped.
+func chmodTree(root string, mode os.FileMode) error {
+	if mode == 0 {
+		return nil
+	}
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode() & os.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(p, mode)
+	})
+}
+
+// LookupOwner resolves "USER[:GROUP]" to numeric ids, using /etc/passwd and /etc/group of the image.
+// Numeric ids are used as they are. Without GROUP, the primary group of the user is used.
+func (b *BuildContext) LookupOwner(owner string) (uid, gid int, err error) {
+	user, group := owner, ""
+	if colon := strings.Index(owner, ":"); colon >= 0 {
+		user, group = owner[:colon], owner[colon+1:]
+	}
+
+	passwdPath, err := b.ResolvePath("/etc/passwd")
+	if err != nil {
+		return -1, -1, err
+	}
+	passwd, err := readDatabase(passwdPath)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	uid, gid = -1, -1
+	for _, entry := range passwd {
+		if len(entry) < 4 || (entry[0] != user && entry[2] != user) {
+			continue
+		}
+		uid, _ = strconv.Atoi(entry[2])
+		gid, _ = strconv.Atoi(entry[3])
+		break
+	}
+
+	if uid < 0 {
+		if uid, err = strconv.Atoi(user); err != nil {
+			return -1, -1, errors.New("No such user in the image: " + user)
+		}
+		gid = uid
+	}
+
+	if group == "" {
+		return uid, gid, nil
+	}
+
+	if gid, err = strconv.Atoi(group); err == nil {
+		return uid, gid, nil
+	}
+
+	groupPath, err := b.ResolvePath("/etc/group")
+	if err != nil {
+		return -1, -1, err
+	}
+	groups, err := readDatabase(groupPath)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	for _, entry := range groups {
+		if len(entry) >= 3 && entry[0] == group {
+			gid, err = strconv.Atoi(entry[2])
+			return uid, gid, err
+		}
+	}
+
+	return -1, -1, errors.New("No such group in the image: " + group)
+}
+
+// readDatabase reads a colon-separated file like /etc/passwd. A missing file is treated as an empty one.
+func readDatabase(name string) ([][]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
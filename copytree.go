@@ -0,0 +1,281 @@
+package siren
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/LEW21/siren/imagectl"
+	"golang.org/x/sys/unix"
+)
+
+// CopyOptions control what CopyTree preserves.
+type CopyOptions struct {
+	PreserveOwner bool // Keep the owners of the source files. Otherwise, the copies are owned by UID:GID.
+	UID, GID int
+
+	Xattrs bool // Copy the extended attributes - including security.* (file capabilities, SELinux labels) and ACLs.
+	Hardlinks bool // Files hardlinked in the source are hardlinked in the copy, instead of being copied multiple times.
+	Sparse bool // Keep the holes of sparse files.
+
+	// If not empty, existing symlinks to directories in the destination are followed like in a chroot at Root.
+	// Otherwise, they are replaced.
+	Root string
+
+	// The copies of the hardlinked files, by (dev, ino) of the source. Share it between CopyTree calls
+	// to keep the hardlinks between their sources. If nil, each call uses a new one.
+	Links map[[2]uint64]string
+}
+
+// CopyTree copies src to dst, like "cp -RT" - if both are directories, the content of src is merged into dst.
+// Symlinks are copied as symlinks, and device nodes and FIFOs are recreated. Modes and modification times are kept.
+func CopyTree(src, dst string, opts CopyOptions) error {
+	links := opts.Links
+	if links == nil {
+		links = map[[2]uint64]string{}
+	}
+	c := &treeCopier{opts, links}
+	return c.copy(src, dst)
+}
+
+type treeCopier struct {
+	opts CopyOptions
+	links map[[2]uint64]string // (dev, ino) -> the first copy.
+}
+
+func (c *treeCopier) copy(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New(src + ": Unsupported file system.")
+	}
+
+	if fi.IsDir() {
+		created := false
+		if dst, created, err = c.prepareDir(dst); err != nil {
+			return err
+		}
+
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := c.copy(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+				return err
+			}
+		}
+		// Like cp - the metadata of the existing directories (eg. /usr) isn't changed.
+		if !created {
+			return nil
+		}
+		return c.copyMetadata(src, dst, fi, st)
+	}
+
+	if fi.Mode() & os.ModeSocket != 0 {
+		return nil
+	}
+
+	if err := removeExisting(dst); err != nil {
+		return err
+	}
+
+	if c.opts.Hardlinks && st.Nlink > 1 {
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := c.links[key]; ok {
+			return os.Link(first, dst)
+		}
+		c.links[key] = dst
+	}
+
+	switch {
+		case fi.Mode() & os.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+
+		case fi.Mode() & (os.ModeDevice | os.ModeNamedPipe) != 0:
+			if err := unix.Mknod(dst, st.Mode, int(st.Rdev)); err != nil {
+				return &os.PathError{Op: "mknod", Path: dst, Err: err}
+			}
+
+		default:
+			if err := c.copyContent(src, dst, fi.Size()); err != nil {
+				return err
+			}
+	}
+
+	return c.copyMetadata(src, dst, fi, st)
+}
+
+// prepareDir makes sure that dst is a directory. Returns its real path, and whether it has been created.
+func (c *treeCopier) prepareDir(dst string) (string, bool, error) {
+	fi, err := os.Lstat(dst)
+	switch {
+		case os.IsNotExist(err):
+			return dst, true, os.Mkdir(dst, 0700)
+
+		case err != nil:
+			return "", false, err
+
+		case fi.IsDir():
+			return dst, false, nil
+
+		case fi.Mode() & os.ModeSymlink != 0 && c.opts.Root != "":
+			resolved, err := imagectl.ResolvePath(c.opts.Root, strings.TrimPrefix(dst, c.opts.Root))
+			if err != nil {
+				return "", false, err
+			}
+			if fi, err := os.Stat(resolved); err == nil && fi.IsDir() {
+				return resolved, false, nil
+			}
+	}
+
+	if err := os.Remove(dst); err != nil {
+		return "", false, err
+	}
+	return dst, true, os.Mkdir(dst, 0700)
+}
+
+func (c *treeCopier) copyContent(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if c.opts.Sparse {
+		err = copySparse(in, out, size)
+	} else {
+		_, err = io.Copy(out, in)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// copySparse copies only the data regions of the file, leaving holes in place of the others.
+func copySparse(in, out *os.File, size int64) error {
+	var offset int64
+	for offset < size {
+		data, err := in.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// Only a hole is left.
+			break
+		}
+		if errors.Is(err, unix.EINVAL) && offset == 0 {
+			// The file system does not support SEEK_DATA.
+			_, err = io.Copy(out, in)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		hole, err := in.Seek(data, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		if _, err := in.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(out, in, hole - data); err != nil {
+			return err
+		}
+		offset = hole
+	}
+	return out.Truncate(size)
+}
+
+// copyMetadata sets the owner, mode, xattrs and times of dst.
+func (c *treeCopier) copyMetadata(src, dst string, fi os.FileInfo, st *syscall.Stat_t) error {
+	uid, gid := c.opts.UID, c.opts.GID
+	if c.opts.PreserveOwner {
+		uid, gid = int(st.Uid), int(st.Gid)
+	}
+	if err := os.Lchown(dst, uid, gid); err != nil {
+		return err
+	}
+
+	symlink := fi.Mode() & os.ModeSymlink != 0
+
+	// After chown - it clears the setuid and setgid bits.
+	if !symlink {
+		if err := os.Chmod(dst, fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	// After chown and chmod - chown clears security.capability, and ACLs are kept in sync with the mode.
+	if c.opts.Xattrs {
+		if err := copyXattrs(src, dst); err != nil {
+			return err
+		}
+	}
+
+	times := []unix.Timespec{unix.NsecToTimespec(st.Atim.Nano()), unix.NsecToTimespec(st.Mtim.Nano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: dst, Err: err}
+	}
+	return nil
+}
+
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+	if size == 0 {
+		return nil
+	}
+
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return &os.PathError{Op: "listxattr", Path: src, Err: err}
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		size, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return &os.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+		value := make([]byte, size)
+		if size, err = unix.Lgetxattr(src, name, value); err != nil {
+			return &os.PathError{Op: "getxattr", Path: src, Err: err}
+		}
+		// The destination file system may not support some of them (eg. security.selinux).
+		if err := unix.Lsetxattr(dst, name, value[:size], 0); err != nil && !errors.Is(err, unix.ENOTSUP) {
+			return &os.PathError{Op: "setxattr " + name, Path: dst, Err: err}
+		}
+	}
+	return nil
+}
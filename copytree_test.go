@@ -0,0 +1,177 @@
+package siren
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "bin/app"), []byte("binary"), 0755)
+	os.Chmod(filepath.Join(src, "bin/app"), 0755 | os.ModeSetgid)
+	os.Link(filepath.Join(src, "bin/app"), filepath.Join(src, "bin/app2"))
+	os.Symlink("bin/app", filepath.Join(src, "app"))
+
+	// A sparse file with a 1 MiB hole.
+	f, _ := os.Create(filepath.Join(src, "sparse"))
+	f.WriteAt([]byte("end"), 1 << 20)
+	f.Close()
+
+	if err := CopyTree(src, dst, CopyOptions{false, os.Getuid(), os.Getgid(), true, true, true, "", nil}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "bin/app"))
+	if err != nil || fi.Mode() != 0755 | os.ModeSetgid {
+		t.Errorf("bin/app mode == %v, %v, want %v", fi.Mode(), err, 0755 | os.ModeSetgid)
+	}
+
+	fi2, err := os.Stat(filepath.Join(dst, "bin/app2"))
+	if err != nil || !os.SameFile(fi, fi2) {
+		t.Errorf("bin/app2 is not a hardlink of bin/app")
+	}
+
+	if target, err := os.Readlink(filepath.Join(dst, "app")); err != nil || target != "bin/app" {
+		t.Errorf("app == %q, %v, want a symlink to %q", target, err, "bin/app")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dst, "sparse"))
+	if err != nil || len(content) != 1 << 20 + 3 || string(content[1 << 20:]) != "end" {
+		t.Errorf("sparse has wrong content")
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sparse")); err == nil {
+		if blocks := fi.Sys().(*syscall.Stat_t).Blocks; blocks * 512 >= 1 << 20 {
+			t.Logf("sparse uses %v blocks - the file system may not support holes", blocks)
+		}
+	}
+}
+
+func TestCopyTreeSharedLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "dst"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("same"), 0644)
+	os.Link(filepath.Join(dir, "a"), filepath.Join(dir, "b"))
+
+	opts := CopyOptions{false, os.Getuid(), os.Getgid(), true, true, true, "", map[[2]uint64]string{}}
+	for _, name := range []string{"a", "b"} {
+		if err := CopyTree(filepath.Join(dir, name), filepath.Join(dir, "dst", name), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, errA := os.Stat(filepath.Join(dir, "dst/a"))
+	b, errB := os.Stat(filepath.Join(dir, "dst/b"))
+	if errA != nil || errB != nil || !os.SameFile(a, b) {
+		t.Errorf("b copied by another CopyTree with the same Links is not a hardlink of a")
+	}
+}
+
+// getxattr returns the value of the extended attribute, or nil if it isn't set.
+func getxattr(t *testing.T, path, name string) []byte {
+	value := make([]byte, 256)
+	size, err := unix.Lgetxattr(path, name, value)
+	if err == unix.ENODATA {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value[:size]
+}
+
+func TestCopyTreeXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	ioutil.WriteFile(src, []byte("data"), 0644)
+	if err := unix.Lsetxattr(src, "user.siren", []byte("value"), 0); err != nil {
+		t.Skipf("The file system does not support user xattrs: %v", err)
+	}
+
+	for _, xattrs := range []bool{true, false} {
+		dst := filepath.Join(dir, "dst")
+		os.Remove(dst)
+		if err := CopyTree(src, dst, CopyOptions{false, os.Getuid(), os.Getgid(), xattrs, true, true, "", nil}); err != nil {
+			t.Fatal(err)
+		}
+		if value := getxattr(t, dst, "user.siren"); (value != nil) != xattrs || xattrs && string(value) != "value" {
+			t.Errorf("user.siren with Xattrs: %v == %q", xattrs, value)
+		}
+	}
+}
+
+func TestCopyTreeOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the owner requires root.")
+	}
+
+	dir, err := ioutil.TempDir("", "siren-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// chown clears the setgid bit and security.capability, so they are set last.
+	src := filepath.Join(dir, "src")
+	ioutil.WriteFile(src, []byte("binary"), 0755)
+	os.Chown(src, 1234, 5678)
+	os.Chmod(src, 0755 | os.ModeSetgid)
+
+	// CAP_NET_BIND_SERVICE, permitted and effective (VFS_CAP_REVISION_2).
+	capability := []byte{1, 0, 0, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if err := unix.Lsetxattr(src, "security.capability", capability, 0); err != nil {
+		t.Logf("Not checking security.capability: %v", err)
+		capability = nil
+	}
+
+	cases := []struct {
+		preserve bool
+		uid, gid uint32
+	}{
+		{true, 1234, 5678},
+		{false, 42, 43},
+	}
+	for _, c := range cases {
+		dst := filepath.Join(dir, "dst")
+		os.Remove(dst)
+		if err := CopyTree(src, dst, CopyOptions{c.preserve, 42, 43, true, true, true, "", nil}); err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := os.Lstat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != c.uid || st.Gid != c.gid {
+			t.Errorf("Owner with PreserveOwner: %v == %v:%v, want %v:%v", c.preserve, st.Uid, st.Gid, c.uid, c.gid)
+		}
+		if fi.Mode() != 0755 | os.ModeSetgid {
+			t.Errorf("Mode with PreserveOwner: %v == %v, want %v", c.preserve, fi.Mode(), 0755 | os.ModeSetgid)
+		}
+		if capability != nil && !bytes.Equal(getxattr(t, dst, "security.capability"), capability) {
+			t.Errorf("security.capability with PreserveOwner: %v == %v, want %v", c.preserve, getxattr(t, dst, "security.capability"), capability)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package siren
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/unit"
+)
+
+// Downloader fetches http(s) files into a cache directory.
+//
+// Cached files are revalidated (ETag / Last-Modified) on every use, interrupted downloads
+// are resumed from FILE.part, and the content can be verified with a SHA-256 checksum.
+type Downloader struct {
+	Dir string
+	Client *http.Client
+}
+
+func NewDownloader(dir string) *Downloader {
+	return &Downloader{dir, http.DefaultClient}
+}
+
+// validators identify the version of a downloaded file. Stored in FILE.meta.
+type validators struct {
+	ETag, LastModified string
+}
+
+func readValidators(path string) validators {
+	v := validators{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return v
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		switch {
+			case strings.HasPrefix(line, "ETag: "):
+				v.ETag = strings.TrimPrefix(line, "ETag: ")
+			case strings.HasPrefix(line, "Last-Modified: "):
+				v.LastModified = strings.TrimPrefix(line, "Last-Modified: ")
+		}
+	}
+	return v
+}
+
+func (v validators) write(path string) error {
+	return ioutil.WriteFile(path, []byte("ETag: " + v.ETag + "\nLast-Modified: " + v.LastModified + "\n"), 0600)
+}
+
+// ifRange returns the value of the If-Range header - it can't use weak ETags.
+func (v validators) ifRange() string {
+	if v.ETag != "" && !strings.HasPrefix(v.ETag, "W/") {
+		return v.ETag
+	}
+	return v.LastModified
+}
+
+// Download returns the path of an up to date copy of the file at uri.
+// If checksum (hex-encoded SHA-256) is not empty, the content has to match it.
+// If the server can't be reached, the cached copy is used.
+func (d *Downloader) Download(uri, checksum string, progress io.Writer) (string, error) {
+	path := filepath.Join(d.Dir, unit.UnitNameEscape(uri))
+
+	for {
+		downloaded, err := d.fetch(uri, path, progress)
+		if err != nil {
+			if _, statErr := os.Stat(path); statErr != nil {
+				return "", err
+			}
+			fmt.Fprintln(progress, "Warning: " + err.Error() + " - using the cached file.")
+		}
+
+		err = VerifyChecksum(path, checksum)
+		if err == nil {
+			return path, nil
+		}
+
+		os.Remove(path)
+		os.Remove(path + ".meta")
+		if downloaded {
+			return "", err
+		}
+		fmt.Fprintln(progress, "Warning: The cached file is corrupted - downloading it again.")
+	}
+}
+
+// Version downloads the file at uri like Download, and returns a string identifying the version of its content -
+// its ETag and Last-Modified, or its SHA-256 if the server sends neither.
+func (d *Downloader) Version(uri, checksum string, progress io.Writer) (string, error) {
+	path, err := d.Download(uri, checksum, progress)
+	if err != nil {
+		return "", err
+	}
+	if v := readValidators(path + ".meta"); v.ETag != "" || v.LastModified != "" {
+		return v.ETag + "\x00" + v.LastModified, nil
+	}
+	return fileSHA256(path)
+}
+
+// fetch downloads the file to path, unless the cached copy is up to date.
+// Returns false if the cached copy is used.
+func (d *Downloader) fetch(uri, path string, progress io.Writer) (bool, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		cached := readValidators(path + ".meta")
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	part := path + ".part"
+	partial := readValidators(part + ".meta")
+	var offset int64
+	if fi, err := os.Stat(part); err == nil && fi.Size() > 0 && partial.ifRange() != "" {
+		offset = fi.Size()
+		req.Header.Set("Range", "bytes=" + strconv.FormatInt(offset, 10) + "-")
+		req.Header.Set("If-Range", partial.ifRange())
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+		case http.StatusNotModified:
+			os.Remove(part)
+			os.Remove(part + ".meta")
+			return false, nil
+
+		case http.StatusPartialContent:
+			if !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes " + strconv.FormatInt(offset, 10) + "-") {
+				return false, errors.New(uri + ": Invalid Content-Range: " + resp.Header.Get("Content-Range"))
+			}
+			fmt.Fprintln(progress, "Resuming the download at " + formatSize(offset) + ".")
+			flags |= os.O_APPEND
+
+		case http.StatusOK:
+			offset = 0
+			flags |= os.O_TRUNC
+			// Saved before the content, so that the download can be resumed if it's interrupted.
+			partial = validators{resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")}
+			if err := partial.write(part + ".meta"); err != nil {
+				return false, err
+			}
+
+		default:
+			return false, errors.New(uri + ": " + resp.Status)
+	}
+
+	f, err := os.OpenFile(part, flags, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	_, err = io.Copy(f, io.TeeReader(resp.Body, &progressWriter{progress, offset, total, 0}))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(part, path); err != nil {
+		return false, err
+	}
+	return true, os.Rename(part + ".meta", path + ".meta")
+}
+
+// progressWriter reports the progress of a download every 10% (or every 16 MiB if the size is unknown).
+type progressWriter struct {
+	w io.Writer
+	done, total int64
+	reported int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+
+	step := int64(16 << 20)
+	if p.total > 0 {
+		step = p.total / 10
+	}
+
+	if step > 0 && p.done / step > p.reported / step || p.done == p.total {
+		p.reported = p.done
+		if p.total >= 0 {
+			fmt.Fprintf(p.w, "Downloaded %v of %v (%v%%)\n", formatSize(p.done), formatSize(p.total), p.done * 100 / max64(p.total, 1))
+		} else {
+			fmt.Fprintf(p.w, "Downloaded %v\n", formatSize(p.done))
+		}
+	}
+	return len(b), nil
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func formatSize(n int64) string {
+	switch {
+		case n >= 1 << 20:
+			return fmt.Sprintf("%.1f MiB", float64(n) / (1 << 20))
+		case n >= 1 << 10:
+			return fmt.Sprintf("%.1f KiB", float64(n) / (1 << 10))
+		default:
+			return strconv.FormatInt(n, 10) + " B"
+	}
+}
+
+// ParseChecksum parses "sha256:HEX" (or just "HEX") into the lowercase hex-encoded SHA-256.
+func ParseChecksum(checksum string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2 * sha256.Size {
+		return "", errors.New("Invalid checksum: " + checksum + " (expected sha256:HEX)")
+	}
+	return sum, nil
+}
+
+// splitFragment separates "sha256=HEX" from the rest of a URI fragment. Parts of the fragment are separated with "&".
+func splitFragment(fragment string) (rest, checksum string) {
+	parts := []string{}
+	for _, part := range strings.Split(fragment, "&") {
+		if strings.HasPrefix(part, "sha256=") {
+			checksum = strings.TrimPrefix(part, "sha256=")
+		} else if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "&"), checksum
+}
+
+// VerifyChecksum checks if the SHA-256 of the file is checksum. An empty checksum matches everything.
+func VerifyChecksum(path, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+
+	want, err := ParseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+
+	got, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return errors.New("Checksum mismatch: expected sha256:" + want + ", got sha256:" + got)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 of the file.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,170 @@
+package siren
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testFile struct {
+	content, etag string
+	requests []*http.Request
+}
+
+func (f *testFile) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r)
+	w.Header().Set("ETag", f.etag)
+	http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(f.content))
+}
+
+func (f *testFile) lastRequest() *http.Request {
+	return f.requests[len(f.requests)-1]
+}
+
+func newTestDownloader(t *testing.T) (*Downloader, func()) {
+	dir, err := ioutil.TempDir("", "siren-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDownloader(dir), func(){os.RemoveAll(dir)}
+}
+
+func download(t *testing.T, d *Downloader, uri, checksum string) string {
+	path, err := d.Download(uri, checksum, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestDownloadRevalidation(t *testing.T) {
+	file := &testFile{"first version", `"1"`, nil}
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d, cleanup := newTestDownloader(t)
+	defer cleanup()
+
+	if got := download(t, d, server.URL, ""); got != file.content {
+		t.Errorf("Download() content == %q, want %q", got, file.content)
+	}
+
+	if got := download(t, d, server.URL, ""); got != file.content {
+		t.Errorf("Download() of a cached file content == %q, want %q", got, file.content)
+	}
+	if inm := file.lastRequest().Header.Get("If-None-Match"); inm != `"1"` {
+		t.Errorf("If-None-Match == %q, want %q", inm, `"1"`)
+	}
+
+	file.content, file.etag = "second version", `"2"`
+	if got := download(t, d, server.URL, ""); got != file.content {
+		t.Errorf("Download() of a changed file content == %q, want %q", got, file.content)
+	}
+}
+
+func TestDownloadVersion(t *testing.T) {
+	file := &testFile{"first version", `"1"`, nil}
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d, cleanup := newTestDownloader(t)
+	defer cleanup()
+
+	first, err := d.Version(server.URL, "", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := d.Version(server.URL, "", &bytes.Buffer{}); err != nil || again != first {
+		t.Errorf("Version() of an unchanged file == %q, %v, want %q", again, err, first)
+	}
+
+	file.content, file.etag = "second version", `"2"`
+	if second, err := d.Version(server.URL, "", &bytes.Buffer{}); err != nil || second == first {
+		t.Errorf("Version() of a changed file == %q, %v, want a new version", second, err)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	file := &testFile{"0123456789abcdef", `"1"`, nil}
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d, cleanup := newTestDownloader(t)
+	defer cleanup()
+
+	path, err := d.Download(server.URL, "", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an interrupted download.
+	os.Remove(path)
+	os.Rename(path + ".meta", path + ".part.meta")
+	ioutil.WriteFile(path + ".part", []byte("0123456789"), 0600)
+
+	if got := download(t, d, server.URL, ""); got != file.content {
+		t.Errorf("Download() of a resumed file content == %q, want %q", got, file.content)
+	}
+	if r := file.lastRequest().Header.Get("Range"); r != "bytes=10-" {
+		t.Errorf("Range == %q, want %q", r, "bytes=10-")
+	}
+
+	// The partial file is outdated - it has to be downloaded from scratch.
+	os.Remove(path)
+	os.Rename(path + ".meta", path + ".part.meta")
+	ioutil.WriteFile(path + ".part", []byte("0123456789"), 0600)
+	file.content, file.etag = "fedcba9876543210", `"2"`
+
+	if got := download(t, d, server.URL, ""); got != file.content {
+		t.Errorf("Download() of a changed resumed file content == %q, want %q", got, file.content)
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	file := &testFile{"content", `"1"`, nil}
+	server := httptest.NewServer(file)
+	defer server.Close()
+
+	d, cleanup := newTestDownloader(t)
+	defer cleanup()
+
+	sum := sha256.Sum256([]byte(file.content))
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+
+	if got := download(t, d, server.URL, checksum); got != file.content {
+		t.Errorf("Download() content == %q, want %q", got, file.content)
+	}
+
+	wrong := "sha256:" + strings.Repeat("0", 64)
+	if _, err := d.Download(server.URL, wrong, &bytes.Buffer{}); err == nil {
+		t.Errorf("Download() with a wrong checksum succeeded")
+	}
+}
+
+func TestSplitFragment(t *testing.T) {
+	cases := []struct {
+		in, rest, checksum string
+	}{
+		{"", "", ""},
+		{"dir/sub", "dir/sub", ""},
+		{"sha256=abc", "", "abc"},
+		{"dir&sha256=abc", "dir", "abc"},
+	}
+	for _, c := range cases {
+		rest, checksum := splitFragment(c.in)
+		if rest != c.rest || checksum != c.checksum {
+			t.Errorf("splitFragment(%q) == %q, %q, want %q, %q", c.in, rest, checksum, c.rest, c.checksum)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package siren
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetEnv handles both "ENV KEY=VALUE..." and "ENV KEY VALUE".
+func (b *BuildContext) SetEnv(arg ...string) error {
+	if len(arg) == 2 && !strings.Contains(arg[0], "=") {
+		arg = []string{arg[0] + "=" + arg[1]}
+	}
+
+	for _, kv := range arg {
+		eq := strings.Index(kv, "=")
+		if eq <= 0 {
+			return errors.New("Invalid environment variable: " + kv + " (expected KEY=VALUE)")
+		}
+		// The environment is stored one variable per line.
+		if strings.Contains(kv, "\n") {
+			return errors.New("Environment variables can't contain newlines: " + kv[:eq])
+		}
+
+		b.Env = setEnv(b.Env, kv[:eq], kv[eq+1:])
+	}
+	return nil
+}
+
+func setEnv(env []string, key, value string) []string {
+	res := make([]string, 0, len(env)+1)
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, key + "=") {
+			res = append(res, kv)
+		}
+	}
+	return append(res, key + "=" + value)
+}
+
+// WriteEnvironment makes the variables set with ENV visible to the services (system.conf.d),
+// user sessions (environment.d), and login shells (profile.d) of the booted image.
+func (b *BuildContext) WriteEnvironment() error {
+	if len(b.Env) == 0 {
+		return nil
+	}
+
+	manager := "[Manager]\nDefaultEnvironment="
+	session := ""
+	profile := ""
+	for i, kv := range b.Env {
+		eq := strings.Index(kv, "=")
+		key, value := kv[:eq], kv[eq+1:]
+
+		if i > 0 {
+			manager += " "
+		}
+		manager += `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(kv) + `"`
+		session += key + "=" + strings.NewReplacer(`\`, `\\`, `$`, `\$`).Replace(value) + "\n"
+		profile += "export " + key + "='" + strings.Replace(value, "'", `'\''`, -1) + "'\n"
+	}
+	manager += "\n"
+
+	files := []struct{path, content string}{
+		{"/usr/lib/systemd/system.conf.d/50-siren-environment.conf", manager},
+		{"/usr/lib/environment.d/50-siren.conf", session},
+		{"/etc/profile.d/siren-environment.sh", profile},
+	}
+
+	for _, f := range files {
+		path, err := b.ResolvePath(f.path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package siren
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSetEnv(t *testing.T) {
+	b := NewBuildContext(nil, "", nil)
+	if err := b.SetEnv("LANG", "C.UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetEnv("A=1", "LANG=en_US.UTF-8"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"A=1", "LANG=en_US.UTF-8"}; !reflect.DeepEqual(b.Env, want) {
+		t.Errorf("Env == %q, want %q", b.Env, want)
+	}
+
+	if err := b.SetEnv("MOTD=Hello\nWorld"); err == nil {
+		t.Errorf("SetEnv() accepted a value with a newline")
+	}
+}
@@ -0,0 +1,87 @@
+package siren
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Glob returns the paths (relative to root) matching the pattern.
+// Supports filepath.Match syntax in every path component, and "**" matching any number of directories.
+// Contents of the matched directories are not returned.
+func Glob(root, pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+
+	if !hasGlobMeta(pattern) {
+		if _, err := os.Lstat(filepath.Join(root, pattern)); err != nil {
+			return nil, err
+		}
+		return []string{pattern}, nil
+	}
+
+	patternParts := strings.Split(pattern, "/")
+	matches := []string{}
+
+	// Walk only the part of the tree the pattern can match - it may be a whole image.
+	start := root
+	for i, part := range patternParts {
+		if hasGlobMeta(part) {
+			start = filepath.Join(root, filepath.Join(patternParts[:i]...))
+			break
+		}
+	}
+	if _, err := os.Stat(start); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	err := filepath.Walk(start, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+
+		if matchGlob(patternParts, strings.Split(rel, "/")) {
+			matches = append(matches, rel)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+
+	sort.Strings(matches)
+	return matches, err
+}
+
+func matchGlob(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchGlob(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], name[1:])
+}
@@ -13,6 +13,21 @@ type Command struct {
 	OptArgs     []string
 	Description string
 	Executor    func(args []string) int
+	Options     []Option
+}
+
+type Option struct {
+	Name        string // Without the leading "--".
+	Value       string // Value placeholder, empty for boolean options.
+	Description string
+	Set         func(value string)
+}
+
+func (o Option) ArgsDescription() string {
+	if o.Value == "" {
+		return "--" + o.Name
+	}
+	return "--" + o.Name + " " + o.Value
 }
 
 func (c Command) ArgsDescription() string {
@@ -20,9 +35,84 @@ func (c Command) ArgsDescription() string {
 	if len(c.OptArgs) > 0 {
 		desc = desc + " [" + strings.Join(c.OptArgs, "] [") + "]"
 	}
+	if len(c.Options) > 0 {
+		desc = "[OPTIONS] " + desc
+	}
 	return desc
 }
 
+func (c Command) PrintUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v %v %v\n\n", os.Args[0], c.Name, c.ArgsDescription())
+	fmt.Fprint(os.Stderr, c.Description + "\n")
+
+	if len(c.Options) > 0 {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "Options:")
+		for _, o := range c.Options {
+			fmt.Fprintf(os.Stderr, "  %-27v %v\n", o.ArgsDescription(), o.Description)
+		}
+	}
+}
+
+// ParseOptions applies all the --options found in args, and returns the remaining positional arguments.
+// Options can be given as "--name value" or "--name=value". Everything after "--" is positional.
+func (c Command) ParseOptions(args []string) ([]string, bool) {
+	positional := make([]string, 0, len(args))
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		value, hasValue := "", false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value, hasValue = name[:eq], name[eq+1:], true
+		}
+
+		var opt *Option
+		for j := range c.Options {
+			if c.Options[j].Name == name {
+				opt = &c.Options[j]
+			}
+		}
+
+		if opt == nil {
+			fmt.Fprintf(os.Stderr, "%v: \"%v\" does not support the --%v option.\n\n", os.Args[0], c.Name, name)
+			c.PrintUsage()
+			return nil, false
+		}
+
+		if opt.Value == "" && hasValue {
+			fmt.Fprintf(os.Stderr, "%v: --%v does not take a value.\n\n", os.Args[0], name)
+			c.PrintUsage()
+			return nil, false
+		}
+
+		if opt.Value != "" && !hasValue {
+			if i+1 >= len(args) {
+				fmt.Fprintf(os.Stderr, "%v: --%v requires a value.\n\n", os.Args[0], name)
+				c.PrintUsage()
+				return nil, false
+			}
+			i++
+			value = args[i]
+		}
+
+		opt.Set(value)
+	}
+
+	return positional, true
+}
+
 func (c Command) CheckArgs(args []string) bool {
 	at_least := len(c.ReqArgs)
 	at_most := len(c.ReqArgs) + len(c.OptArgs)
@@ -40,8 +130,7 @@ func (c Command) CheckArgs(args []string) bool {
 		} else {
 			fmt.Fprintf(os.Stderr, "%v: \"%v\" requires at least %v arguments.\n\n", os.Args[0], c.Name, at_least)
 		}
-		fmt.Fprintf(os.Stderr, "Usage: %v %v %v\n\n", os.Args[0], c.Name, c.ArgsDescription())
-		fmt.Fprint(os.Stderr, c.Description + "\n")
+		c.PrintUsage()
 		return false
 	}
 	if len(args) > at_most && !strings.HasSuffix(last_arg, "...") {
@@ -50,14 +139,23 @@ func (c Command) CheckArgs(args []string) bool {
 		} else {
 			fmt.Fprintf(os.Stderr, "%v: \"%v\" takes at most %v arguments.\n\n", os.Args[0], c.Name, at_most)
 		}
-		fmt.Fprintf(os.Stderr, "Usage: %v %v %v\n\n", os.Args[0], c.Name, c.ArgsDescription())
-		fmt.Fprint(os.Stderr, c.Description + "\n")
+		c.PrintUsage()
 		return false
 	}
 	return true
 }
 
 func (c Command) Run(args []string) int {
+	if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+		c.PrintUsage()
+		return 0
+	}
+
+	args, ok := c.ParseOptions(args)
+	if !ok {
+		return 1
+	}
+
 	if !c.CheckArgs(args) {
 		return 1
 	}
@@ -4,12 +4,39 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"github.com/fatih/color"
 )
 
 var Commands = []Command{CmdCreate, CmdTag, CmdSetReadOnly, CmdSetReady, CmdRemove, CmdList, CmdRebase}
 
-var CmdCreate = Command{[]string{"new"}, "create", []string{"NAME"}, []string{"BASE_NAME"}, "Create a new image", cmdCreate}
+// Labels set with --label.
+var labels = map[string]string{}
+
+var labelOptionList = []Option{
+	{"label", "KEY=VALUE", "Add a label to the image", addLabelOption},
+}
+
+func addLabelOption(label string) {
+	key, value, err := ParseLabel(label)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	labels[key] = value
+}
+
+func printLabelError(err error) int {
+	switch err {
+		case ErrNotLayered:
+			fmt.Fprintln(os.Stderr, "Not a layered image. Only layered images can have labels.")
+			return 1
+		default:
+			panic(err)
+	}
+}
+
+var CmdCreate = Command{[]string{"new"}, "create", []string{"NAME"}, []string{"BASE_NAME"}, "Create a new image", cmdCreate, labelOptionList}
 func cmdCreate(args []string) int {
 	thisName := args[0]
 	baseName := ""
@@ -51,7 +78,23 @@ func cmdCreate(args []string) int {
 		}
 	}
 
+	if err := AddLabels(i, labels); err != nil {
+		return printLabelError(err)
+	}
+
 	fmt.Println("Image created.")
+
+	switch err := WriteNspawnFile(i.Name(), base); err {
+		case nil:
+			if l, ok := base.(*LayeredImage); ok && !l.NspawnSettings().Empty() {
+				fmt.Println("nspawn settings of the base image written to " + NspawnFilePath(i.Name()) + ".")
+			}
+		case ErrNspawnFileExists:
+			fmt.Fprintln(os.Stderr, "Warning: " + NspawnFilePath(i.Name()) + " already exists. The nspawn settings of the base image were not written.")
+		default:
+			panic(err)
+	}
+
 	fmt.Println("Use machinectl start " + i.Name() + " to start the container.")
 	return 0
 }
@@ -72,7 +115,7 @@ func printChangeError(err error) int {
 	}
 }
 
-var CmdRemove = Command{[]string{"rm"}, "remove", []string{"NAME..."}, nil, "Remove an image", cmdRemove}
+var CmdRemove = Command{[]string{"rm"}, "remove", []string{"NAME..."}, nil, "Remove an image", cmdRemove, nil}
 func cmdRemove(args []string) int {
 	ictl, err := New()
 	if err != nil {
@@ -104,6 +147,10 @@ func cmdRemove(args []string) int {
 			return printChangeError(err)
 		}
 
+		if err := RemoveNspawnFile(thisName); err != nil {
+			panic(err)
+		}
+
 		fmt.Println(thisName + ": Image removed.")
 	}
 	return 0
@@ -126,7 +173,7 @@ var BoolValues = map[string]bool {
 	"FALSE": false,
 }
 
-var CmdSetReadOnly = Command{[]string{"ro", "read-only"}, "set-read-only", []string{"NAME"}, []string{"BOOL"}, "Mark or unmark image read-only", cmdSetReadOnly}
+var CmdSetReadOnly = Command{[]string{"ro", "read-only"}, "set-read-only", []string{"NAME"}, []string{"BOOL"}, "Mark or unmark image read-only", cmdSetReadOnly, nil}
 func cmdSetReadOnly(args []string) int {
 	thisName := args[0]
 	svalue := "y"
@@ -163,7 +210,7 @@ func cmdSetReadOnly(args []string) int {
 	return 0
 }
 
-var CmdSetReady = Command{nil, "set-ready", []string{"NAME"}, []string{"BOOL"}, "Assemble or disassemble layered image", cmdSetReady}
+var CmdSetReady = Command{nil, "set-ready", []string{"NAME"}, []string{"BOOL"}, "Assemble or disassemble layered image", cmdSetReady, nil}
 func cmdSetReady(args []string) int {
 	thisName := args[0]
 	svalue := "y"
@@ -200,7 +247,7 @@ func cmdSetReady(args []string) int {
 	return 0
 }
 
-var CmdTag = Command{nil, "tag", []string{"TAG", "NAME"}, nil, "Create an alias for the image", cmdTag}
+var CmdTag = Command{nil, "tag", []string{"TAG", "NAME"}, nil, "Create an alias for the image", cmdTag, labelOptionList}
 func cmdTag(args []string) int {
 	tag := args[0]
 	thisName := args[1]
@@ -216,6 +263,23 @@ func cmdTag(args []string) int {
 		return 1
 	}
 
+	if len(labels) > 0 {
+		ictl, err := New()
+		if err != nil {
+			panic(err)
+		}
+
+		// Labels are stored by the layered images, not by machined.
+		image, err := ictl.GetImage(thisName)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := AddLabels(image, labels); err != nil {
+			return printLabelError(err)
+		}
+	}
+
 	if err := Tag(tag, &this); err != nil {
 		panic(err)
 	}
@@ -225,18 +289,43 @@ func cmdTag(args []string) int {
 }
 
 // machinectl list-images / docker images
-var CmdList = Command{[]string{"ls", "list-images", "images"}, "list", nil, nil, "Show available container and VM images", cmdList}
+var CmdList = Command{[]string{"ls", "list-images", "images"}, "list", nil, nil, "Show available container and VM images", cmdList, []Option{
+	{"filter", "label=KEY[=VALUE]", "Show only the images with the label", func(filter string){listFilters = append(listFilters, filter)}},
+}}
+
+var listFilters []string
+
 func cmdList(args []string) int {
+	labelFilters := []string{}
+	for _, filter := range listFilters {
+		if !strings.HasPrefix(filter, "label=") {
+			fmt.Fprintln(os.Stderr, "Unsupported filter: " + filter + " (expected label=KEY[=VALUE])")
+			return 1
+		}
+		labelFilters = append(labelFilters, strings.TrimPrefix(filter, "label="))
+	}
+
 	ictl, err := New()
 	if err != nil {
 		panic(err)
 	}
 
-	images, err := ictl.ListImages()
+	all, err := ictl.ListImages()
 	if err != nil {
 		panic(err)
 	}
 
+	images := make([]Image, 0, len(all))
+	for _, i := range all {
+		matches := true
+		for _, filter := range labelFilters {
+			matches = matches && MatchesLabel(i, filter)
+		}
+		if matches {
+			images = append(images, i)
+		}
+	}
+
 	columns := []Column{
 		{"NAME",  func(i interface{})(string, color.Attribute){return i.(Image).Name(), 0}},
 		{"TYPE",  func(i interface{})(string, color.Attribute){return i.(Image).Type(), 0}},
@@ -263,6 +352,7 @@ func cmdList(args []string) int {
 				return "no", color.FgBlue
 			}
 		}},
+		{"LABELS", func(i interface{})(string, color.Attribute){return FormatLabels(i.(Image).Labels(), ","), 0}},
 	}
 	data := make([]interface{}, len(images))
 	for i := range data {
@@ -276,7 +366,7 @@ func cmdList(args []string) int {
 	return 0
 }
 
-var CmdRebase = Command{nil, "rebase", []string{"NAME", "NEW_BASE"}, nil, "Change the base image of an image", cmdRebase}
+var CmdRebase = Command{nil, "rebase", []string{"NAME", "NEW_BASE"}, nil, "Change the base image of an image", cmdRebase, nil}
 func cmdRebase(args []string) int {
 	thisName := args[0]
 	newBaseName := args[1]
@@ -3,6 +3,7 @@ package imagectl
 import (
 	"errors"
 	"os/exec"
+	"strings"
 	"github.com/LEW21/siren/imagectl/machine1"
 )
 
@@ -16,6 +17,7 @@ type Image interface {
 	// Custom properties
 	Ready() bool // Is ready to use? (In case of layered images: is it mounted?)
 	Alive() bool // Is our image used as a machined's container?
+	Labels() map[string]string // Set with LABEL or imagectl create --label. Only layered images can have them.
 
 	// Soft actions
 	Update() error // Reload all properties
@@ -38,6 +40,25 @@ var ErrImageExists = errors.New("image already exists") // for CreateImage()
 var ErrBaseWritable = errors.New("base image is writable") // for CreateImage()
 var ErrBaseDoesNotExist = errors.New("base image does not exist") // for CreateImage()
 
+// IsValidName checks if the name can be used as an image (and machine) name.
+// The rules are the same as in systemd's machine_name_is_valid().
+func IsValidName(name string) bool {
+	if len(name) == 0 || len(name) > 64 {
+		return false
+	}
+
+	if name[0] == '.' || name[len(name)-1] == '.' || strings.Contains(name, "..") {
+		return false
+	}
+
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 func ImageRealPath(i Image, path string) string {
 	if len(path) > 0 && path[0] != '/' {
 		panic("RealPath: The argument has to be an absolute path.")
@@ -45,13 +66,38 @@ func ImageRealPath(i Image, path string) string {
 	return i.Path() + path
 }
 
+type CommandOptions struct {
+	Env []string // KEY=VALUE pairs, set in the environment of the command.
+	WorkDir string // Working directory of the command, "/" if empty.
+	User, Group string // Run the command as this user (and group) instead of root.
+	Binds []string // Additional directories bound into the image: HOST_PATH[:PATH]. They have to exist.
+}
+
 func ImageCommand(i Image, name string, arg ...string) *exec.Cmd {
-	cacheDirs := []string{"/var/cache/pacman/pkg", "/var/cache/pip/http"}
+	return ImageCommandWithOptions(i, CommandOptions{}, name, arg...)
+}
+
+func ImageCommandWithOptions(i Image, opts CommandOptions, name string, arg ...string) *exec.Cmd {
+	args := make([]string, 0, len(opts.Binds) * 2 + len(opts.Env) + 3 + len(arg))
+
+	for _, bind := range opts.Binds {
+		args = append(args, "--bind", bind)
+	}
+
+	for _, env := range opts.Env {
+		args = append(args, "--setenv=" + env)
+	}
 
-	args := make([]string, 0, len(cacheDirs) * 2 + 3 + len(arg))
+	if opts.WorkDir != "" && opts.WorkDir != "/" {
+		args = append(args, "--chdir=" + opts.WorkDir)
+	}
 
-	for _, dir := range cacheDirs {
-		args = append(args, "--bind", dir)
+	if opts.Group != "" {
+		// systemd-nspawn --user does not support groups.
+		arg = append([]string{"-u", opts.User, "-g", opts.Group, "--", name}, arg...)
+		name = "runuser"
+	} else if opts.User != "" {
+		args = append(args, "--user=" + opts.User)
 	}
 
 	args = append(args, "-M", i.Name(), name)
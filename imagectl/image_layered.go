@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"io/ioutil"
+	"strings"
 	systemd "github.com/coreos/go-systemd/dbus"
 	"github.com/LEW21/siren/imagectl/machine1"
 )
@@ -24,7 +25,7 @@ func (lictl LayeredImageCtl) GetImage(name string) (LayeredImage, error) {
 		name = target
 	}
 
-	i := LayeredImage{name, nil, false, lictl.getAnyImage, false, false, lictl.md}
+	i := LayeredImage{name, nil, false, nil, nil, NspawnSettings{}, lictl.getAnyImage, false, false, lictl.md}
 	err := i.Update()
 	return i, err
 }
@@ -59,7 +60,7 @@ func (lictl LayeredImageCtl) CreateImage(name string, base Image) (LayeredImage,
 		return LayeredImage{}, ErrImageExists
 	}
 
-	i := LayeredImage{name, base, false, lictl.getAnyImage, false, false, lictl.md}
+	i := LayeredImage{name, base, false, nil, nil, NspawnSettings{}, lictl.getAnyImage, false, false, lictl.md}
 	err := i.create()
 	return i, err
 }
@@ -68,6 +69,9 @@ type LayeredImage struct {
 	id string
 	base Image
 	frozen bool
+	env []string
+	labels map[string]string
+	nspawn NspawnSettings
 
 	getAnyImage ImageGetter
 	ready, alive bool
@@ -128,6 +132,28 @@ func (i *LayeredImage) Update() error {
 	frozen, _ := ioutil.ReadFile(i.LayerPath("/frozen"))
 	i.frozen = string(frozen) != "n"
 
+	i.env = nil
+	env, _ := ioutil.ReadFile(i.LayerPath("/env"))
+	for _, kv := range strings.Split(string(env), "\n") {
+		if kv != "" {
+			i.env = append(i.env, kv)
+		}
+	}
+
+	i.labels = nil
+	labels, _ := ioutil.ReadFile(i.LayerPath("/labels"))
+	for _, kv := range strings.Split(string(labels), "\n") {
+		if key, value, err := ParseLabel(kv); err == nil {
+			if i.labels == nil {
+				i.labels = map[string]string{}
+			}
+			i.labels[key] = value
+		}
+	}
+
+	nspawn, _ := ioutil.ReadFile(i.LayerPath("/nspawn"))
+	i.nspawn = ParseNspawnSettings(string(nspawn))
+
 	fi, err := os.Stat(i.Path())
 	i.ready = err == nil && fi.IsDir()
 
@@ -183,6 +209,36 @@ func (i *LayeredImage) Rebase(newBase Image) error {
 	return nil
 }
 
+// Environment returns the KEY=VALUE pairs set with ENV when the image was built.
+func (i *LayeredImage) Environment() []string {
+	return i.env
+}
+
+func (i *LayeredImage) SetEnvironment(env []string) error {
+	i.env = env
+	return i.saveMetadata()
+}
+
+func (i *LayeredImage) Labels() map[string]string {
+	return i.labels
+}
+
+// SetLabels replaces the labels of the image. They can be changed even if the image is frozen.
+func (i *LayeredImage) SetLabels(labels map[string]string) error {
+	i.labels = labels
+	return i.saveMetadata()
+}
+
+// NspawnSettings returns the settings set with PORT, BIND, NETWORK_ZONE and CAPABILITY when the image was built.
+func (i *LayeredImage) NspawnSettings() NspawnSettings {
+	return i.nspawn
+}
+
+func (i *LayeredImage) SetNspawnSettings(s NspawnSettings) error {
+	i.nspawn = s
+	return i.saveMetadata()
+}
+
 func (i *LayeredImage) SetReady(ready bool) error {
 	if i.Ready() == ready {
 		return nil
@@ -285,6 +341,30 @@ func (i *LayeredImage) saveMetadata() error {
 		return err
 	}
 
+	if len(i.env) > 0 {
+		if err := ioutil.WriteFile(i.LayerPath("/env"), []byte(strings.Join(i.env, "\n") + "\n"), 0644); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(i.LayerPath("/env"))
+	}
+
+	if len(i.labels) > 0 {
+		if err := ioutil.WriteFile(i.LayerPath("/labels"), []byte(FormatLabels(i.labels, "\n") + "\n"), 0644); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(i.LayerPath("/labels"))
+	}
+
+	if !i.nspawn.Empty() {
+		if err := ioutil.WriteFile(i.LayerPath("/nspawn"), []byte(i.nspawn.Format()), 0644); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(i.LayerPath("/nspawn"))
+	}
+
 	return nil
 }
 
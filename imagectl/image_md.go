@@ -128,6 +128,10 @@ func (i *MdImage) Alive() bool {
 	return i.alive
 }
 
+func (i *MdImage) Labels() map[string]string {
+	return nil
+}
+
 // Utilities
 
 func (i *MdImage) RealPath(path string) string {
@@ -35,6 +35,10 @@ func (i *StdImage) Alive() bool {
 	return i.alive
 }
 
+func (i *StdImage) Labels() map[string]string {
+	return nil
+}
+
 // Utilities
 
 func (i *StdImage) RealPath(path string) string {
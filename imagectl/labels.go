@@ -0,0 +1,64 @@
+package imagectl
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrNotLayered = errors.New("not a layered image") // for labels
+
+// ParseLabel parses "KEY=VALUE". "KEY" alone means an empty value.
+func ParseLabel(label string) (key, value string, err error) {
+	key = label
+	if eq := strings.Index(label, "="); eq >= 0 {
+		key, value = label[:eq], label[eq+1:]
+	}
+
+	if key == "" || strings.ContainsAny(key, " \t\n") || strings.Contains(value, "\n") {
+		return "", "", errors.New("Invalid label: " + label + " (expected KEY=VALUE)")
+	}
+	return key, value, nil
+}
+
+// FormatLabels returns the KEY=VALUE pairs sorted by key, and joined with sep.
+func FormatLabels(labels map[string]string, sep string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key + "=" + value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, sep)
+}
+
+// AddLabels sets the labels on the image, keeping the other ones it has.
+func AddLabels(i Image, labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+
+	l, ok := i.(*LayeredImage)
+	if !ok {
+		return ErrNotLayered
+	}
+
+	merged := map[string]string{}
+	for key, value := range l.Labels() {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	return l.SetLabels(merged)
+}
+
+// MatchesLabel checks if the image has the label. filter is "KEY" (any value) or "KEY=VALUE".
+func MatchesLabel(i Image, filter string) bool {
+	key, value, hasValue := filter, "", false
+	if eq := strings.Index(filter, "="); eq >= 0 {
+		key, value, hasValue = filter[:eq], filter[eq+1:], true
+	}
+
+	actual, ok := i.Labels()[key]
+	return ok && (!hasValue || actual == value)
+}
@@ -0,0 +1,232 @@
+package imagectl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NspawnSettings are the systemd-nspawn settings the containers of an image need - set with PORT, BIND,
+// NETWORK_ZONE and CAPABILITY. imagectl create writes them to the .nspawn file of the new container.
+type NspawnSettings struct {
+	Capabilities []string // [Exec] Capability=
+	Binds []string // [Files] Bind= - SOURCE[:DEST]
+	ReadOnlyBinds []string // [Files] BindReadOnly=
+	Zone string // [Network] Zone=
+	Ports []string // [Network] Port= - [PROTO:]HOST_PORT[:CONTAINER_PORT]
+}
+
+func (s NspawnSettings) Empty() bool {
+	return len(s.Capabilities) == 0 && len(s.Binds) == 0 && len(s.ReadOnlyBinds) == 0 && s.Zone == "" && len(s.Ports) == 0
+}
+
+// Merge returns the settings of s with the ones of o added. The zone of o wins, if it has one.
+func (s NspawnSettings) Merge(o NspawnSettings) NspawnSettings {
+	zone := s.Zone
+	if o.Zone != "" {
+		zone = o.Zone
+	}
+	return NspawnSettings{
+		mergeUnique(s.Capabilities, o.Capabilities),
+		mergeUnique(s.Binds, o.Binds),
+		mergeUnique(s.ReadOnlyBinds, o.ReadOnlyBinds),
+		zone,
+		mergeUnique(s.Ports, o.Ports),
+	}
+}
+
+func mergeUnique(a, b []string) []string {
+	merged := []string{}
+	seen := map[string]bool{}
+	for _, v := range append(append([]string{}, a...), b...) {
+		if !seen[v] {
+			seen[v] = true
+			merged = append(merged, v)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// Format returns the settings in the .nspawn file format.
+func (s NspawnSettings) Format() string {
+	sections := []string{}
+
+	if len(s.Capabilities) > 0 {
+		sections = append(sections, "[Exec]\nCapability=" + strings.Join(s.Capabilities, " ") + "\n")
+	}
+
+	files := ""
+	for _, bind := range s.Binds {
+		files += "Bind=" + bind + "\n"
+	}
+	for _, bind := range s.ReadOnlyBinds {
+		files += "BindReadOnly=" + bind + "\n"
+	}
+	if files != "" {
+		sections = append(sections, "[Files]\n" + files)
+	}
+
+	network := ""
+	if s.Zone != "" {
+		network += "Zone=" + s.Zone + "\n"
+	}
+	for _, port := range s.Ports {
+		network += "Port=" + port + "\n"
+	}
+	if network != "" {
+		sections = append(sections, "[Network]\n" + network)
+	}
+
+	return strings.Join(sections, "\n")
+}
+
+// ParseNspawnSettings parses a .nspawn file. Settings other than the ones of NspawnSettings are ignored.
+func ParseNspawnSettings(content string) NspawnSettings {
+	s := NspawnSettings{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		eq := strings.Index(line, "=")
+		if eq < 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		key, value := strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:])
+		switch key {
+			case "Capability":
+				s.Capabilities = append(s.Capabilities, strings.Fields(value)...)
+			case "Bind":
+				s.Binds = append(s.Binds, value)
+			case "BindReadOnly":
+				s.ReadOnlyBinds = append(s.ReadOnlyBinds, value)
+			case "Zone":
+				s.Zone = value
+			case "Port":
+				s.Ports = append(s.Ports, value)
+		}
+	}
+	return s
+}
+
+// ParsePort checks a port mapping in the format of nspawn's --port: [tcp|udp:]HOST_PORT[:CONTAINER_PORT].
+func ParsePort(port string) error {
+	parts := strings.Split(port, ":")
+	if parts[0] == "tcp" || parts[0] == "udp" {
+		parts = parts[1:]
+	}
+	if len(parts) < 1 || len(parts) > 2 {
+		return errors.New("Invalid port: " + port + " (expected [tcp|udp:]HOST_PORT[:CONTAINER_PORT])")
+	}
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return errors.New("Invalid port: " + port + " (expected [tcp|udp:]HOST_PORT[:CONTAINER_PORT])")
+		}
+	}
+	return nil
+}
+
+// ParseBind returns the nspawn Bind= value for the host directory source mounted at dest in the container.
+// If dest is empty, it is the same as source.
+func ParseBind(source, dest string) (string, error) {
+	for _, path := range []string{source, dest} {
+		if path != "" && !filepath.IsAbs(path) {
+			return "", errors.New("Bind paths have to be absolute: " + path)
+		}
+		if strings.ContainsAny(path, ":\n") {
+			return "", errors.New("Bind paths can't contain \":\": " + path)
+		}
+	}
+	if dest == "" || dest == source {
+		return source, nil
+	}
+	return source + ":" + dest, nil
+}
+
+// IsValidZone checks if the name can be used as a network zone. nspawn names the zone's bridge
+// "vz-" + name, and interface names are limited to 15 characters.
+func IsValidZone(name string) bool {
+	if len(name) == 0 || len(name) > 12 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsValidCapability checks if the name looks like a capability name (eg. CAP_NET_ADMIN), or is "all".
+func IsValidCapability(name string) bool {
+	if name == "all" {
+		return true
+	}
+	if !strings.HasPrefix(name, "CAP_") || len(name) == len("CAP_") {
+		return false
+	}
+	for _, r := range name[len("CAP_"):] {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// SetNspawnSettings replaces the nspawn settings of the image.
+func SetNspawnSettings(i Image, s NspawnSettings) error {
+	l, ok := i.(*LayeredImage)
+	if !ok {
+		return ErrNotLayered
+	}
+	return l.SetNspawnSettings(s)
+}
+
+var ErrNspawnFileExists = errors.New("nspawn file exists") // for WriteNspawnFile()
+
+// Only the files with this header are overwritten and removed by imagectl.
+const nspawnFileHeader = "# Generated by imagectl from the settings of the image "
+
+func NspawnFilePath(machine string) string {
+	return "/etc/systemd/nspawn/" + machine + ".nspawn"
+}
+
+// WriteNspawnFile writes the nspawn settings of the image to the .nspawn file of the machine,
+// so that machinectl start uses them. Does nothing if the image has no settings.
+// Files not written by imagectl are never overwritten - ErrNspawnFileExists is returned instead.
+func WriteNspawnFile(machine string, image Image) error {
+	l, ok := image.(*LayeredImage)
+	if !ok || l.NspawnSettings().Empty() {
+		return nil
+	}
+
+	if content, err := ioutil.ReadFile(NspawnFilePath(machine)); err == nil && !strings.HasPrefix(string(content), nspawnFileHeader) {
+		return ErrNspawnFileExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(NspawnFilePath(machine)), 0755); err != nil {
+		return err
+	}
+	content := nspawnFileHeader + image.Name() + ".\n\n" + l.NspawnSettings().Format()
+	return ioutil.WriteFile(NspawnFilePath(machine), []byte(content), 0644)
+}
+
+// RemoveNspawnFile removes the .nspawn file of the machine, if it has been written by WriteNspawnFile.
+func RemoveNspawnFile(machine string) error {
+	content, err := ioutil.ReadFile(NspawnFilePath(machine))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(string(content), nspawnFileHeader) {
+		return nil
+	}
+	return os.Remove(NspawnFilePath(machine))
+}
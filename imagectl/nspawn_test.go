@@ -0,0 +1,43 @@
+package imagectl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNspawnSettings(t *testing.T) {
+	s := NspawnSettings{
+		Capabilities: []string{"CAP_NET_ADMIN"},
+		Binds: []string{"/srv/data:/data"},
+		Ports: []string{"tcp:80:8080"},
+	}
+	s = s.Merge(NspawnSettings{Capabilities: []string{"CAP_NET_ADMIN", "CAP_SYS_TIME"}, ReadOnlyBinds: []string{"/etc/ssl"}, Zone: "web"})
+
+	want := NspawnSettings{
+		Capabilities: []string{"CAP_NET_ADMIN", "CAP_SYS_TIME"},
+		Binds: []string{"/srv/data:/data"},
+		ReadOnlyBinds: []string{"/etc/ssl"},
+		Zone: "web",
+		Ports: []string{"tcp:80:8080"},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Fatalf("Merge() == %+v, want %+v", s, want)
+	}
+
+	if parsed := ParseNspawnSettings(s.Format()); !reflect.DeepEqual(parsed, want) {
+		t.Errorf("ParseNspawnSettings(Format()) == %+v, want %+v\n%v", parsed, want, s.Format())
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	for _, port := range []string{"80", "tcp:80", "udp:53:5353", "8080:80"} {
+		if err := ParsePort(port); err != nil {
+			t.Errorf("ParsePort(%q) == %v", port, err)
+		}
+	}
+	for _, port := range []string{"", "sctp:80", "80:80:80", "http", "0", "70000"} {
+		if err := ParsePort(port); err == nil {
+			t.Errorf("ParsePort(%q) succeeded", port)
+		}
+	}
+}
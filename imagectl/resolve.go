@@ -0,0 +1,73 @@
+package imagectl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symlinks are resolved like the kernel does, including the limit.
+const maxSymlinks = 40
+
+// ResolvePath returns the real path of path inside the root directory (eg. of an image).
+// Symlinks are interpreted like in a chroot: absolute ones relative to root, and ".." never leads above root -
+// so the result is always inside root. Components that don't exist are kept as they are.
+func ResolvePath(root, path string) (string, error) {
+	return resolvePath(root, path, true)
+}
+
+// ResolvePathNoFollow is like ResolvePath, but the last component is not followed if it is a symlink.
+// For paths that are going to be replaced or removed.
+func ResolvePathNoFollow(root, path string) (string, error) {
+	return resolvePath(root, path, false)
+}
+
+func resolvePath(root, path string, followLast bool) (string, error) {
+	pending := strings.Split(path, "/")
+	resolved := []string{}
+
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+			case "", ".":
+				continue
+			case "..":
+				if len(resolved) > 0 {
+					resolved = resolved[:len(resolved)-1]
+				}
+				continue
+		}
+
+		if len(pending) == 0 && !followLast {
+			resolved = append(resolved, part)
+			break
+		}
+
+		current := filepath.Join(root, filepath.Join(resolved...), part)
+		fi, err := os.Lstat(current)
+		if err != nil || fi.Mode() & os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New(path + ": too many levels of symbolic links")
+		}
+
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = []string{}
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
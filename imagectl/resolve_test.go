@@ -0,0 +1,48 @@
+package imagectl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "imagectl-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "usr/lib"), 0755)
+	os.Symlink("/", filepath.Join(root, "etc"))
+	os.Symlink("usr/lib", filepath.Join(root, "lib"))
+	os.Symlink("../../..", filepath.Join(root, "usr/lib/up"))
+	os.Symlink("/usr/lib/missing", filepath.Join(root, "usr/lib/link"))
+
+	cases := []struct {
+		path, want string
+	}{
+		{"/etc/foo", "/foo"},
+		{"/etc/etc/passwd", "/passwd"},
+		{"/lib/foo", "/usr/lib/foo"},
+		{"/lib/up/foo", "/foo"},
+		{"/../../foo", "/foo"},
+		{"/usr/lib/link", "/usr/lib/missing"},
+	}
+	for _, c := range cases {
+		got, err := ResolvePath(root, c.path)
+		if err != nil || got != filepath.Join(root, c.want) {
+			t.Errorf("ResolvePath(%q) == %q, %v, want %q", c.path, got, err, filepath.Join(root, c.want))
+		}
+	}
+
+	if got, _ := ResolvePathNoFollow(root, "/lib/link"); got != filepath.Join(root, "usr/lib/link") {
+		t.Errorf("ResolvePathNoFollow(%q) == %q, want %q", "/lib/link", got, filepath.Join(root, "usr/lib/link"))
+	}
+
+	os.Symlink("loop", filepath.Join(root, "loop"))
+	if _, err := ResolvePath(root, "/loop/foo"); err == nil {
+		t.Errorf("ResolvePath() of a symlink loop succeeded")
+	}
+}
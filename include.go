@@ -0,0 +1,103 @@
+package siren
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ResolveIncludes splices the instructions of the INCLUDEd files in place of the INCLUDE instructions.
+// Paths are relative to the build directory. Git URIs (like in FROM) are cloned or updated first -
+// their fragment is the path of the file in the repository. Progress is written to writer.
+func ResolveIncludes(directory string, instructions []Instruction, writer io.Writer) ([]Instruction, error) {
+	instructions, errs := resolveIncludes(directory, instructions, writer, []string{directory + "/Sirenfile"})
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return instructions, nil
+}
+
+// resolveIncludes skips the INCLUDEs that can't be resolved, and returns all the errors found.
+// stack contains the names of the files being included - to detect cycles.
+func resolveIncludes(directory string, instructions []Instruction, writer io.Writer, stack []string) ([]Instruction, []error) {
+	errs := []error{}
+	result := make([]Instruction, 0, len(instructions))
+
+	for _, in := range instructions {
+		if in.Args[0] != "INCLUDE" {
+			result = append(result, in)
+			continue
+		}
+
+		if len(in.Args) != 2 {
+			errs = append(errs, in.Errorf(0, "INCLUDE requires exactly 1 argument."))
+			continue
+		}
+
+		name, path, err := includedFile(directory, in.Args[1], writer)
+		if err != nil {
+			errs = append(errs, in.Errorf(1, "%v", err))
+			continue
+		}
+
+		cycle := false
+		for i, included := range stack {
+			if included == name {
+				errs = append(errs, in.Errorf(1, "Include cycle: %v -> %v", strings.Join(stack[i:], " -> "), name))
+				cycle = true
+			}
+		}
+		if cycle {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			errs = append(errs, in.Errorf(1, "%v", err))
+			continue
+		}
+
+		// Errors in the included file point at it, not at the INCLUDE.
+		included, parseErrs := parseSirenfile(name, string(content))
+		errs = append(errs, parseErrs...)
+
+		included, includeErrs := resolveIncludes(directory, included, writer, append(stack[:len(stack):len(stack)], name))
+		errs = append(errs, includeErrs...)
+
+		result = append(result, included...)
+	}
+
+	return result, errs
+}
+
+// includedFile returns the name (used in the error messages) and the real path of the INCLUDEd file.
+func includedFile(directory, arg string, writer io.Writer) (name, path string, err error) {
+	if u, err := ParseGitURI(arg); err == nil {
+		file := strings.TrimPrefix(u.Fragment, "/")
+		if file == "" {
+			return "", "", errors.New("The path of the file in the repository is missing: " + arg + "#PATH")
+		}
+		u.Fragment = ""
+
+		task := NewTask(writer, "Fetching " + u.String()); defer task.Finish()
+		repoRoot, err := fetchGitRepo(u.String(), task)
+		if err != nil {
+			return "", "", err
+		}
+
+		path, err := resolveInside(repoRoot, file)
+		return arg, path, err
+	}
+
+	if filepath.IsAbs(arg) {
+		return "", "", errors.New("Included files have to be in the build directory: " + arg)
+	}
+
+	path, err = resolveInside(directory, arg)
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(directory, arg), path, nil
+}
@@ -0,0 +1,469 @@
+package siren
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// InstructionDef describes a Sirenfile instruction.
+// Programs embedding siren can add their own instructions with RegisterInstruction.
+type InstructionDef struct {
+	Name string
+	MinArgs, MaxArgs int // Not counting the options. MaxArgs: -1 - no limit.
+	Options []string // Supported --options. Options taking values end with "=". nil - the arguments are not checked for options at all.
+	Usage string // eg. "COPY SRC... DST"
+	Help string
+
+	// Exec executes the instruction. nil for instructions handled before the build (ID, FROM, ARG, STAGE, INCLUDE).
+	Exec func(b *BuildContext, cmd Instruction) error
+
+	// The last MinArgs arguments of TrailingArgs instructions are positional even if they start with "--"
+	// (eg. SET PATH VALUE) - only the arguments before them can be options.
+	TrailingArgs bool
+
+	// Block instructions are followed by a body (Instruction.Body), ending with an "END" line.
+	Block bool
+
+	// StateOnly instructions change only the BuildContext, not the image - they don't get their own cached layers.
+	StateOnly bool
+
+	// UpdateState is called instead of Exec when the layer of the instruction is taken from the cache.
+	// Needed only for instructions changing both the image and the BuildContext.
+	UpdateState func(b *BuildContext, args []string)
+
+	// Inputs returns the paths (relative to the build directory) read by the instruction.
+	// Their content is a part of the cache key.
+	Inputs func(b *BuildContext, cmd Instruction) []string
+
+	// State returns the parts of the BuildContext (other than the environment, WORKDIR, USER and SHELL) read by the instruction.
+	// It is a part of the cache key.
+	State func(b *BuildContext, cmd Instruction) string
+
+	// Images returns the names of the images (or stages) read by the instruction.
+	// Names of the images they point to are a part of the cache key.
+	Images func(b *BuildContext, cmd Instruction) []string
+}
+
+var instructions = map[string]InstructionDef{}
+
+// RegisterInstruction makes the instruction available in Sirenfiles.
+// Panics if an instruction with the same name is already registered.
+func RegisterInstruction(def InstructionDef) {
+	if _, ok := instructions[def.Name]; ok {
+		panic("RegisterInstruction: " + def.Name + " is already registered.")
+	}
+	instructions[def.Name] = def
+}
+
+func LookupInstruction(name string) (InstructionDef, bool) {
+	def, ok := instructions[name]
+	return def, ok
+}
+
+// Instructions returns all the registered instructions, sorted by name.
+func Instructions() []InstructionDef {
+	names := make([]string, 0, len(instructions))
+	for name := range instructions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]InstructionDef, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, instructions[name])
+	}
+	return defs
+}
+
+func init() {
+	RegisterInstruction(InstructionDef{
+		Name: "ID", MinArgs: 1, MaxArgs: 2,
+		Usage: "ID NAME [VERSION]",
+		Help: "Name and version of the image. The image is tagged as NAME-VERSION.",
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "FROM", MinArgs: 1, MaxArgs: -1,
+		Usage: "FROM NAME [SOURCE...]",
+		Help: "Base image. If it does not exist, it is pulled from the first working git SOURCE.",
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "INCLUDE", MinArgs: 1, MaxArgs: 1,
+		Usage: "INCLUDE PATH | INCLUDE GIT_URI#PATH",
+		Help: "Insert the instructions of another file (in the build directory, or in a git repository) in place of the INCLUDE.",
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "STAGE", MinArgs: 1, MaxArgs: 1,
+		Usage: "STAGE NAME",
+		Help: "Start a build stage - the following instructions (up to the next STAGE or ID) build a temporary image, discarded after the build. Use COPY --from=NAME to copy files out of it.",
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "ARG", MinArgs: 1, MaxArgs: 2,
+		Usage: "ARG NAME [DEFAULT]",
+		Help: "Declare a build argument, used as ${NAME} and set with --build-arg NAME=VALUE.",
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "RUN", MinArgs: 1, MaxArgs: -1,
+		Usage: "RUN COMMAND [ARG...] | RUN [INTERPRETER...] <<EOF",
+		Help: "Run a command inside the image, or a script written on the following lines (up to EOF).",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			arg := cmd.Args[1:]
+			if isHeredoc(arg[len(arg)-1]) {
+				return b.RunScript(arg[:len(arg)-1], cmd.Body)
+			}
+			return b.Run(arg[0], arg[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "PACKAGE", MinArgs: 0, MaxArgs: -1,
+		Options: []string{"remove", "upgrade"},
+		Usage: "PACKAGE NAME... | PACKAGE --remove NAME... | PACKAGE --upgrade [NAME...]",
+		Help: "Install, remove or upgrade packages with the package manager of the image (pacman, apt, dnf, zypper or apk - detected from its os-release), as root. Downloaded packages are cached in /var/lib/siren/cache, and the package lists are removed from the layer.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Package(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "COPY", MinArgs: 2, MaxArgs: -1,
+		Options: []string{"chown=", "chmod=", "from=", "preserve-owner"},
+		Usage: "COPY [--from=IMAGE] [--chown=USER[:GROUP] | --preserve-owner] [--chmod=MODE] SRC... DST",
+		Help: "Copy files from the build directory (or from a STAGE or any other image) to the image. SRC can contain wildcards, including \"**\". If there are multiple sources, DST has to end with \"/\". Modes, xattrs (eg. file capabilities) and hardlinks are kept. The copies are owned by root, unless --chown or --preserve-owner is used.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Copy(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			inputs := []string{}
+			for _, matches := range b.copyMatches(cmd) {
+				inputs = append(inputs, matches...)
+			}
+			return inputs
+		},
+		State: func(b *BuildContext, cmd Instruction) string {
+			// Which pattern matched which files - moving a file between the patterns changes its destination.
+			state := ""
+			for _, matches := range b.copyMatches(cmd) {
+				state += strings.Join(matches, "\x00") + "\x00\x00"
+			}
+			return state
+		},
+		Images: func(b *BuildContext, cmd Instruction) []string {
+			opts, _ := SplitOptions(cmd.Args[1:])
+			if from := opts.Get("from"); from != "" {
+				return []string{from}
+			}
+			return nil
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "UNTAR", MinArgs: 2, MaxArgs: -1,
+		Options: []string{"checksum="},
+		Usage: "UNTAR [--checksum=sha256:HEX] TARBALL[#SUBDIR][&sha256=HEX]... DST",
+		Help: "Extract tarballs (plain, or compressed with gzip, bzip2, xz or zstd) from the build directory or http(s) URLs to the image. With #SUBDIR, only the content of SUBDIR is extracted. Downloads are cached, and revalidated with the server on every build. If a checksum is given, the tarball has to match it.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Untar(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			_, args := SplitOptions(cmd.Args[1:])
+			inputs := []string{}
+			for _, tarfile := range args[:len(args)-1] {
+				u, err := url.Parse(tarfile)
+				if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+					inputs = append(inputs, u.Path)
+				}
+			}
+			return inputs
+		},
+		State: func(b *BuildContext, cmd Instruction) string {
+			opts, args := SplitOptions(cmd.Args[1:])
+			state := ""
+			for _, tarfile := range args[:len(args)-1] {
+				u, err := url.Parse(tarfile)
+				if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+					continue
+				}
+				_, checksum := splitFragment(u.Fragment)
+				if checksum == "" {
+					checksum = opts.Get("checksum")
+				}
+				u.Fragment = ""
+				state += b.remoteVersion(u, checksum) + "\x00"
+			}
+			return state
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "DOWNLOAD", MinArgs: 2, MaxArgs: 2,
+		Options: []string{"mode=", "sha256="},
+		Usage: "DOWNLOAD [--mode=MODE] [--sha256=HEX] URL DST",
+		Help: "Download a file from an http(s) URL to the image, through the same cache as UNTAR. If DST ends with \"/\", the file is named after the URL. The mode is 0644 by default.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.DownloadFile(cmd.Args[1:]...)
+		},
+		State: func(b *BuildContext, cmd Instruction) string {
+			opts, args := SplitOptions(cmd.Args[1:])
+			u, err := url.Parse(args[0])
+			if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				return ""
+			}
+			_, checksum := splitFragment(u.Fragment)
+			if sha := opts.Get("sha256"); sha != "" {
+				checksum = sha
+			}
+			u.Fragment = ""
+			return b.remoteVersion(u, checksum)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "PATCH", MinArgs: 1, MaxArgs: -1,
+		Options: []string{"strip=", "fuzz=", "reverse"},
+		Usage: "PATCH [--strip=N] [--fuzz=N] [--reverse] DIFF...",
+		Help: "Apply unified diffs from the build directory to the files in the image. The paths in the diffs are relative to WORKDIR, after stripping N leading components (1 by default, like in git diffs). Moved hunks are found, but the context has to match, unless --fuzz allows ignoring N context lines. If any hunk doesn't apply, nothing is changed.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Patch(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			_, args := SplitOptions(cmd.Args[1:])
+			return args
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "SET", MinArgs: 2, MaxArgs: 2,
+		Options: []string{"mode="}, TrailingArgs: true,
+		Usage: "SET [--mode=MODE] PATH VALUE",
+		Help: "Write VALUE to the file at PATH. New files get mode 0644, and the existing ones keep their modes, unless --mode is given.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Set(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "APPEND", MinArgs: 2, MaxArgs: 2,
+		Options: []string{"mode="}, TrailingArgs: true,
+		Usage: "APPEND [--mode=MODE] PATH VALUE",
+		Help: "Append VALUE as a new line to the file at PATH, creating it if needed. Modes work like in SET.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Append(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "TEMPLATE", MinArgs: 2, MaxArgs: 2,
+		Options: []string{"mode="},
+		Usage: "TEMPLATE [--mode=MODE] SRC DST",
+		Help: "Render a Go text/template from the build directory to the image. The template can use {{.Name}} and {{.Version}} (from ID), {{.Args.NAME}} (build arguments), {{.Labels.KEY}} and {{.OSRelease.KEY}} (os-release of the image). If DST is a directory, the \".tmpl\" suffix is removed from the name. Modes work like in SET.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Template(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			_, args := SplitOptions(cmd.Args[1:])
+			return args[:1]
+		},
+		State: func(b *BuildContext, cmd Instruction) string {
+			return b.templateState()
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "ADD_UNIT", MinArgs: 1, MaxArgs: 1,
+		Options: []string{"user"},
+		Usage: "ADD_UNIT [--user] UNIT | ADD_UNIT [--user] UNIT.d[/FILE]",
+		Help: "Copy a systemd unit (of any type - .service by default), or a drop-in directory or file, from the build directory to the image. For instances of templates (foo@bar.service), the template is copied. With --user, it is a user unit.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddUnit(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			_, args := SplitOptions(cmd.Args[1:])
+			return []string{unitSource(args[0])}
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "ENABLE", MinArgs: 1, MaxArgs: 1,
+		Options: []string{"user", "preset"},
+		Usage: "ENABLE [--user] [--preset] UNIT",
+		Help: "Enable a systemd unit, copying it from the build directory first if it is there. With --user, it is enabled for all the users. With --preset, it is added to a preset file instead, and enabled by systemd on the first boot.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Enable(cmd.Args[1:]...)
+		},
+		Inputs: func(b *BuildContext, cmd Instruction) []string {
+			_, args := SplitOptions(cmd.Args[1:])
+			return []string{unitFile(unitName(args[0]))}
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "SERVICE", MinArgs: 1, MaxArgs: 1,
+		Options: []string{"user", "enable", "preset", "no-verify"},
+		Block: true,
+		Usage: "SERVICE [--user] [--enable [--preset]] [--no-verify] UNIT",
+		Help: "Write the following lines (up to END) to the unit file (UNIT.service by default), verifying it with systemd-analyze verify if the host's systemd supports --root. With --enable, the unit is also enabled, like with ENABLE.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Service(cmd.Body, cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "DISABLE", MinArgs: 1, MaxArgs: 1,
+		Options: []string{"user", "preset"},
+		Usage: "DISABLE [--user] [--preset] UNIT",
+		Help: "Disable a systemd unit, also if it was enabled by a base image. With --preset, it is added to a preset file instead.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Disable(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "MASK", MinArgs: 1, MaxArgs: 1,
+		Options: []string{"user"},
+		Usage: "MASK [--user] UNIT",
+		Help: "Mask a systemd unit, so that it can't be started at all.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Mask(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "NETWORK", MinArgs: 0, MaxArgs: 0,
+		Options: []string{"dhcp", "address=", "gateway=", "dns=", "domain=", "route="},
+		Usage: "NETWORK [--dhcp] [--address=ADDRESS/PREFIX]... [--gateway=IP]... [--dns=IP]... [--domain=DOMAIN]... [--route=DESTINATION[,GATEWAY]]...",
+		Help: "Configure the network of the container (the host0 interface) with systemd-networkd, and enable systemd-networkd and systemd-resolved. Without --address, DHCP is used. Replaces the config of the previous NETWORK.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.Network(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "SYSUSER", MinArgs: 2, MaxArgs: 6,
+		Options: []string{"apply"},
+		Usage: "SYSUSER [--apply] TYPE NAME [ID] [GECOS] [HOME] [SHELL]",
+		Help: "Declare a system user or group in /usr/lib/sysusers.d, created by systemd on boot. With --apply, it is also created now, with the host's systemd-sysusers --root.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddSysUser(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "TMPFILE", MinArgs: 2, MaxArgs: 7,
+		Options: []string{"apply"},
+		Usage: "TMPFILE [--apply] TYPE PATH [MODE] [USER] [GROUP] [AGE] [ARGUMENT]",
+		Help: "Declare a file or directory in /usr/lib/tmpfiles.d, created by systemd on boot. With --apply, it is also created now, with the host's systemd-tmpfiles --root.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddTmpFile(cmd.Args[1:]...)
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "ENV", MinArgs: 1, MaxArgs: -1,
+		Usage: "ENV KEY=VALUE...",
+		Help: "Set environment variables for the following RUN commands, and for the booted image.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.SetEnv(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "LABEL", MinArgs: 1, MaxArgs: -1,
+		Usage: "LABEL KEY=VALUE...",
+		Help: "Add labels to the image metadata. Use imagectl list --filter label=KEY=VALUE to find the images.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.SetLabels(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "PORT", MinArgs: 1, MaxArgs: -1,
+		Usage: "PORT [tcp|udp:]HOST_PORT[:CONTAINER_PORT]...",
+		Help: "Forward a host port to the containers created from the image with imagectl create. Requires private networking (the default of machinectl start).",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddPorts(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "BIND", MinArgs: 1, MaxArgs: 2,
+		Options: []string{"ro"},
+		Usage: "BIND [--ro] HOST_PATH [CONTAINER_PATH]",
+		Help: "Bind mount a host directory into the containers created from the image with imagectl create.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddBind(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "NETWORK_ZONE", MinArgs: 1, MaxArgs: 1,
+		Usage: "NETWORK_ZONE NAME",
+		Help: "Connect the containers created from the image with imagectl create to the network zone (a bridge shared with the other containers of the zone).",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.SetNetworkZone(cmd.Args[1])
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "CAPABILITY", MinArgs: 1, MaxArgs: -1,
+		Usage: "CAPABILITY CAP...",
+		Help: "Give the capabilities (eg. CAP_NET_ADMIN) to the containers created from the image with imagectl create.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddCapabilities(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "WORKDIR", MinArgs: 1, MaxArgs: 1,
+		Usage: "WORKDIR PATH",
+		Help: "Set (and create) the working directory of the following RUN commands. Relative COPY destinations are resolved against it.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.SetWorkDir(cmd.Args[1])
+		},
+		UpdateState: func(b *BuildContext, args []string) {
+			b.WorkDir = b.ImagePath(args[0])
+		},
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "USER", MinArgs: 1, MaxArgs: 1,
+		Usage: "USER NAME[:GROUP]",
+		Help: "Run the following RUN commands as the given user.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.SetUser(cmd.Args[1])
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "CACHE", MinArgs: 1, MaxArgs: -1,
+		Usage: "CACHE DIR...",
+		Help: "Bind build caches (in /var/lib/siren/cache) to the directories during the following RUN commands, eg. CACHE /var/cache/pip/http. Their content is shared by the builds, and not stored in the image.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			return b.AddCaches(cmd.Args[1:]...)
+		},
+		StateOnly: true,
+	})
+
+	RegisterInstruction(InstructionDef{
+		Name: "SHELL", MinArgs: 1, MaxArgs: -1,
+		Usage: "SHELL INTERPRETER [ARG...]",
+		Help: "Set the interpreter of RUN <<EOF scripts. /bin/sh -e by default.",
+		Exec: func(b *BuildContext, cmd Instruction) error {
+			b.Shell = cmd.Args[1:]
+			return nil
+		},
+		StateOnly: true,
+	})
+}
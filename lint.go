@@ -0,0 +1,429 @@
+package siren
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// LintSirenfile reads, parses and checks the Sirenfile in directory. Returns all the problems found.
+// The progress of fetching the INCLUDEd git repositories is written to writer.
+func LintSirenfile(directory string, buildArgs map[string]string, writer io.Writer) []error {
+	path := directory + "/Sirenfile"
+
+	sirenfile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+
+	instructions, problems := parseSirenfile(path, string(sirenfile))
+
+	instructions, includeProblems := resolveIncludes(directory, instructions, writer, []string{path})
+	problems = append(problems, includeProblems...)
+
+	instructions, _, warnings, err := expandInstructions(instructions, buildArgs)
+	if err != nil {
+		return append(problems, err)
+	}
+	problems = append(problems, warnings...)
+
+	return append(problems, Lint(directory, instructions)...)
+}
+
+func arguments(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return strconv.Itoa(n) + " arguments"
+}
+
+// Warning is a problem that doesn't make the build fail, but is likely a mistake.
+type Warning struct {
+	error
+}
+
+// IsWarning checks if the problem is only a Warning.
+func IsWarning(problem error) bool {
+	_, ok := problem.(Warning)
+	return ok
+}
+
+// Lint checks the parsed (and expanded) instructions for problems that would make the build fail.
+// Returns all the problems found, including Warnings.
+func Lint(directory string, instructions []Instruction) []error {
+	problems := []error{}
+
+	inMetadata := true // Are we still in the leading ID / FROM block (of the Sirenfile or of a STAGE)?
+	inStage := false
+	hasID := false
+	stages := map[string]bool{}
+	units := map[string]bool{} // Unit files added by ADD_UNIT and SERVICE.
+	installs := false // Can the instructions so far (of the Sirenfile or of a STAGE) install units?
+	caches := map[string]bool{}
+
+	for _, in := range instructions {
+		name := in.Args[0]
+		arg := in.Args[1:]
+
+		switch {
+			case name == "STAGE":
+				inMetadata, inStage = true, true
+				units, installs, caches = map[string]bool{}, false, map[string]bool{}
+			case name == "ID" && inStage:
+				// ID ends the stages.
+				inMetadata, inStage = true, false
+				units, installs, caches = map[string]bool{}, false, map[string]bool{}
+			case name != "ID" && name != "FROM":
+				inMetadata = false
+			case !inMetadata:
+				problems = append(problems, in.Errorf(0, "%v has to be placed at the beginning of the Sirenfile or of a STAGE.", name))
+		}
+
+		def, _ := LookupInstruction(name)
+		if err := def.checkOptions(in); err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		_, arg = def.splitArgs(arg)
+
+		if len(arg) < def.MinArgs {
+			problems = append(problems, in.Errorf(0, "%v requires at least %v.", name, arguments(def.MinArgs)))
+			continue
+		}
+		if def.MaxArgs >= 0 && len(arg) > def.MaxArgs {
+			problems = append(problems, in.Errorf(0, "%v takes at most %v.", name, arguments(def.MaxArgs)))
+		}
+
+		switch name {
+			case "ID":
+				hasID = true
+				tag := arg[0]
+				if len(arg) >= 2 {
+					tag += "-" + arg[1]
+				}
+				// ReadMetadata adds a 17-character suffix to the tag.
+				if !imagectl.IsValidName(tag + "-0123456789abcdef") {
+					problems = append(problems, in.Errorf(1, "Invalid image name: %v (only letters, digits, \"-\", \"_\" and \".\" are allowed, and the name and version have to be at most 47 characters long together)", tag))
+				}
+
+			case "FROM":
+				if !imagectl.IsValidName(arg[0]) {
+					problems = append(problems, in.Errorf(1, "Invalid base image name: %v", arg[0]))
+				}
+				for i, source := range arg[1:] {
+					if _, err := ParseGitURI(source); err != nil {
+						problems = append(problems, in.Errorf(i+2, "Invalid base image source: %v", err))
+					}
+				}
+
+			case "STAGE":
+				if stages[arg[0]] {
+					problems = append(problems, in.Errorf(1, "Duplicate stage name: %v", arg[0]))
+				}
+				stages[arg[0]] = true
+				// Without the cache, the stage is built in an image called stageImageName.
+				if !imagectl.IsValidName(stageImageName(arg[0], "0123456789abcdef")) {
+					problems = append(problems, in.Errorf(1, "Invalid stage name: %v (only letters, digits, \"-\", \"_\" and \".\" are allowed, up to 35 characters)", arg[0]))
+				}
+
+			case "COPY":
+				opts, _ := SplitOptions(in.Args[1:])
+				if opts.Has("chown") && opts.Has("preserve-owner") {
+					problems = append(problems, in.Errorf(argIndex(in, "--preserve-owner"), "--chown and --preserve-owner can't be used together."))
+				}
+				if mode := opts.Get("chmod"); mode != "" {
+					if _, err := ParseMode(mode); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, "--chmod=" + mode), "%v", err))
+					}
+				}
+				if from := opts.Get("from"); from != "" {
+					// Stages have to be built before they are used. Other images are checked during the build.
+					if !stages[from] && !imagectl.IsValidName(from) {
+						problems = append(problems, in.Errorf(argIndex(in, "--from=" + from), "No such stage, and not a valid image name: %v", from))
+					}
+					break
+				}
+				for _, pattern := range arg[:len(arg)-1] {
+					problems = appendIfNoMatch(problems, directory, in, pattern)
+				}
+
+			case "DOWNLOAD":
+				opts, _ := SplitOptions(in.Args[1:])
+				if mode := opts.Get("mode"); mode != "" {
+					if _, err := ParseMode(mode); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, "--mode=" + mode), "%v", err))
+					}
+				}
+				if sha := opts.Get("sha256"); sha != "" {
+					if _, err := ParseChecksum(sha); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, "--sha256=" + sha), "%v", err))
+					}
+				}
+				if u, err := url.Parse(arg[0]); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "Invalid URI: %v", err))
+				} else if u.Scheme != "http" && u.Scheme != "https" {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "Only http and https URLs can be downloaded: %v", arg[0]))
+				}
+
+			case "UNTAR":
+				opts, _ := SplitOptions(in.Args[1:])
+				if checksum := opts.Get("checksum"); checksum != "" {
+					if _, err := ParseChecksum(checksum); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, "--checksum=" + checksum), "%v", err))
+					}
+				}
+				for _, src := range arg[:len(arg)-1] {
+					col := argIndex(in, src)
+					u, err := url.Parse(src)
+					if err != nil {
+						problems = append(problems, in.Errorf(col, "Invalid URI: %v", err))
+						continue
+					}
+					if _, checksum := splitFragment(u.Fragment); checksum != "" {
+						if _, err := ParseChecksum(checksum); err != nil {
+							problems = append(problems, in.Errorf(col, "%v", err))
+						}
+					}
+					if u.Scheme != "http" && u.Scheme != "https" {
+						problems = appendIfMissing(problems, directory, in, col, u.Path)
+					}
+				}
+
+			case "PATCH":
+				opts, _ := SplitOptions(in.Args[1:])
+				if _, _, err := patchOptions(opts); err != nil {
+					problems = append(problems, in.Errorf(0, "%v", err))
+				}
+				for _, diff := range arg {
+					before := len(problems)
+					problems = appendIfMissing(problems, directory, in, argIndex(in, diff), diff)
+					if len(problems) > before {
+						continue
+					}
+					realPath, _ := resolveInside(directory, diff)
+					content, err := ioutil.ReadFile(realPath)
+					if err == nil {
+						_, err = ParsePatch(string(content))
+					}
+					if err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, diff), "%v: %v", diff, err))
+					}
+				}
+
+			case "SET", "APPEND", "TEMPLATE":
+				opts, _ := SplitOptions(in.Args[1:])
+				if mode := opts.Get("mode"); mode != "" {
+					if _, err := ParseMode(mode); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, "--mode=" + mode), "%v", err))
+					}
+				}
+				if name != "TEMPLATE" {
+					break
+				}
+				before := len(problems)
+				problems = appendIfMissing(problems, directory, in, argIndex(in, arg[0]), arg[0])
+				if len(problems) > before {
+					break
+				}
+				realPath, _ := resolveInside(directory, arg[0])
+				content, err := ioutil.ReadFile(realPath)
+				if err == nil {
+					err = CheckTemplate(arg[0], string(content))
+				}
+				if err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+				}
+
+			case "LABEL":
+				for _, label := range arg {
+					if _, _, err := imagectl.ParseLabel(label); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, label), "%v", err))
+					}
+				}
+
+			case "PACKAGE":
+				opts, _ := SplitOptions(in.Args[1:])
+				if opts.Has("remove") && opts.Has("upgrade") {
+					problems = append(problems, in.Errorf(argIndex(in, "--upgrade"), "--remove and --upgrade can't be used together."))
+				}
+				if len(arg) == 0 && !opts.Has("upgrade") {
+					problems = append(problems, in.Errorf(0, "PACKAGE requires package names, unless --upgrade is used."))
+				}
+
+			case "NETWORK":
+				opts, _ := SplitOptions(in.Args[1:])
+				if _, err := ParseNetworkConfig(opts); err != nil {
+					problems = append(problems, in.Errorf(0, "%v", err))
+				}
+
+			case "SYSUSER":
+				if err := CheckSysUser(arg); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+				}
+
+			case "TMPFILE":
+				if err := CheckTmpFile(arg); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+				}
+
+			case "PORT":
+				for _, port := range arg {
+					if err := imagectl.ParsePort(port); err != nil {
+						problems = append(problems, in.Errorf(argIndex(in, port), "%v", err))
+					}
+				}
+
+			case "BIND":
+				dest := ""
+				if len(arg) >= 2 {
+					dest = arg[1]
+				}
+				if _, err := imagectl.ParseBind(arg[0], dest); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+				}
+
+			case "RUN":
+				for _, cache := range runCaches(in) {
+					if !caches[cache] {
+						problems = append(problems, in.Warnf(0, "The host's %v is no longer bound to RUN by default. Add CACHE %v before it to keep the downloads out of the layer.", cache, cache))
+					}
+				}
+
+			case "CACHE":
+				for _, dir := range arg {
+					caches[path.Clean(dir)] = true
+				}
+
+			case "NETWORK_ZONE":
+				if !imagectl.IsValidZone(arg[0]) {
+					problems = append(problems, in.Errorf(1, "Invalid network zone: %v (only letters, digits, \"-\" and \"_\" are allowed, up to 12 characters)", arg[0]))
+				}
+
+			case "CAPABILITY":
+				for _, capability := range arg {
+					if !imagectl.IsValidCapability(capability) {
+						problems = append(problems, in.Errorf(argIndex(in, capability), "Invalid capability: %v", capability))
+					}
+				}
+
+			case "ADD_UNIT":
+				problems = appendIfMissing(problems, directory, in, argIndex(in, arg[0]), unitSource(arg[0]))
+				units[unitSource(arg[0])] = true
+
+			case "SERVICE":
+				if err := CheckUnitName(arg[0]); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+				}
+				if opts, _ := SplitOptions(in.Args[1:]); opts.Has("preset") && !opts.Has("enable") {
+					problems = append(problems, in.Errorf(argIndex(in, "--preset"), "--preset can be used only with --enable."))
+				}
+				if !strings.Contains(in.Body, "[") {
+					problems = append(problems, in.Errorf(0, "The unit has no sections. Write the unit file on the lines following SERVICE, up to END."))
+				}
+				units[unitName(arg[0])] = true
+
+			case "ENABLE", "DISABLE", "MASK":
+				if err := CheckUnitName(arg[0]); err != nil {
+					problems = append(problems, in.Errorf(argIndex(in, arg[0]), "%v", err))
+					break
+				}
+				// Without any instruction installing the unit, only the base image can provide it - checked during the build.
+				if source := unitFile(unitName(arg[0])); name == "ENABLE" && !units[source] && !installs {
+					realPath, err := resolveInside(directory, source)
+					if err == nil {
+						_, err = os.Stat(realPath)
+					}
+					if err != nil {
+						problems = append(problems, in.Warnf(argIndex(in, arg[0]), "%v is not in the build directory, nor installed by the Sirenfile - it has to be provided by the base image.", source))
+					}
+				}
+		}
+
+		switch name {
+			case "RUN", "PACKAGE", "COPY", "UNTAR", "DOWNLOAD":
+				installs = true
+		}
+	}
+
+	if !hasID {
+		problems = append(problems, errors.New("No ID instruction."))
+	}
+
+	return problems
+}
+
+// Package managers that used to have their caches bound from the host during every RUN.
+var packageCaches = map[string]string{
+	"pacman": "/var/cache/pacman/pkg",
+	"pip": "/var/cache/pip/http",
+	"pip3": "/var/cache/pip/http",
+}
+
+// runCaches returns the caches of the package managers the RUN command (or its script) seems to use.
+func runCaches(in Instruction) []string {
+	words := strings.FieldsFunc(strings.Join(in.Args[1:], " ") + "\n" + in.Body, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(";&|()`'\"", r)
+	})
+
+	caches := []string{}
+	seen := map[string]bool{}
+	for _, word := range words {
+		if cache, ok := packageCaches[path.Base(word)]; ok && !seen[cache] {
+			caches = append(caches, cache)
+			seen[cache] = true
+		}
+	}
+	return caches
+}
+
+func appendIfNoMatch(problems []error, directory string, in Instruction, pattern string) []error {
+	col := argIndex(in, pattern)
+
+	if filepath.IsAbs(pattern) {
+		return append(problems, in.Errorf(col, "Source paths have to be relative to the build directory: %v", pattern))
+	}
+
+	if clean := filepath.Clean(pattern); clean == ".." || strings.HasPrefix(clean, "../") {
+		return append(problems, in.Errorf(col, "Source paths can't lead outside of the build directory: %v", pattern))
+	}
+
+	if matches, err := Glob(directory, pattern); err != nil || len(matches) == 0 {
+		return append(problems, in.Errorf(col, "No files in the build directory match: %v", pattern))
+	}
+	return problems
+}
+
+// argIndex finds the index of the argument in the instruction - for error locations.
+func argIndex(in Instruction, arg string) int {
+	for i, a := range in.Args {
+		if a == arg {
+			return i
+		}
+	}
+	return 0
+}
+
+func appendIfMissing(problems []error, directory string, in Instruction, arg int, path string) []error {
+	if filepath.IsAbs(path) {
+		return append(problems, in.Errorf(arg, "Source paths have to be relative to the build directory: %v", path))
+	}
+
+	realPath, err := resolveInside(directory, path)
+	if err != nil {
+		return append(problems, in.Errorf(arg, "%v", err))
+	}
+
+	if _, err := os.Stat(realPath); err != nil {
+		return append(problems, in.Errorf(arg, "No such file in the build directory: %v", path))
+	}
+	return problems
+}
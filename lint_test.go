@@ -0,0 +1,78 @@
+package siren
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lintWarnings lints the Sirenfile, which has to have no problems other than Warnings.
+func lintWarnings(t *testing.T, directory, sirenfile string) []string {
+	instructions, err := ParseSirenfile("Sirenfile", sirenfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := []string{}
+	for _, problem := range Lint(directory, instructions) {
+		if !IsWarning(problem) {
+			t.Fatalf("Lint(%q): %v", sirenfile, problem)
+		}
+		warnings = append(warnings, problem.Error())
+	}
+	return warnings
+}
+
+func TestLintEnable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "app.service"), []byte("[Service]\n"), 0644)
+
+	cases := []struct {
+		sirenfile string
+		warns bool
+	}{
+		{"ID test\nENABLE app\n", false},
+		{"ID test\nENABLE sshd\n", true},
+		{"ID test\nENABLE getty@tty1\n", true},
+		{"ID test\nPACKAGE openssh\nENABLE sshd\n", false},
+		{"ID test\nSERVICE worker\n[Service]\nEND\nENABLE worker\n", false},
+		{"ID test\nDISABLE sshd\n", false},
+		{"STAGE build\nRUN make\nID test\nENABLE sshd\n", true},
+	}
+	for _, c := range cases {
+		warnings := lintWarnings(t, dir, c.sirenfile)
+		if warns := len(warnings) > 0; warns != c.warns {
+			t.Errorf("Lint(%q) warnings: %q, want warnings: %v", c.sirenfile, warnings, c.warns)
+		}
+		for _, warning := range warnings {
+			if !strings.Contains(warning, "base image") {
+				t.Errorf("Lint(%q) warning: %q, want it to mention the base image", c.sirenfile, warning)
+			}
+		}
+	}
+}
+
+func TestLintPackageCaches(t *testing.T) {
+	cases := []struct {
+		sirenfile string
+		warnings int
+	}{
+		{"ID test\nRUN pacman -S --noconfirm git\n", 1},
+		{"ID test\nCACHE /var/cache/pacman/pkg\nRUN pacman -S --noconfirm git\n", 0},
+		{"ID test\nCACHE /var/cache/pacman/pkg/\nRUN /usr/bin/pacman -S --noconfirm git\n", 0},
+		{"ID test\nRUN sh <<EOF\npacman -Syu --noconfirm && pip install gunicorn\nEOF\n", 2},
+		{"ID test\nCACHE /var/cache/pip/http\nRUN sh -c \"pip3 install flask\"\n", 0},
+		{"ID test\nRUN pacman-key --init\n", 0},
+		{"STAGE build\nCACHE /var/cache/pip/http\nID test\nRUN pip install flask\n", 1},
+	}
+	for _, c := range cases {
+		if warnings := lintWarnings(t, "", c.sirenfile); len(warnings) != c.warnings {
+			t.Errorf("Lint(%q) warnings: %q, want %v", c.sirenfile, warnings, c.warnings)
+		}
+	}
+}
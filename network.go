@@ -0,0 +1,121 @@
+package siren
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NETWORK writes the networkd config of the host0 interface (the container side of nspawn's veth) to /usr/lib,
+// like the rest of the systemd config (see moveSystemdConfigToUsr). It sorts before 80-container-host0.network
+// shipped by systemd, so it is used instead of it.
+const networkConfig = "/usr/lib/systemd/network/70-siren-host0.network"
+
+// NetworkConfig is the configuration of host0 set with NETWORK.
+type NetworkConfig struct {
+	DHCP bool
+	Addresses []string // ADDRESS/PREFIX
+	Gateways []string
+	DNS []string
+	Domains []string
+	Routes [][2]string // Destination, and gateway ("" - on-link).
+}
+
+// ParseNetworkConfig parses the options of NETWORK. Without --address, DHCP is used.
+func ParseNetworkConfig(opts Options) (NetworkConfig, error) {
+	c := NetworkConfig{opts.Has("dhcp"), opts["address"], opts["gateway"], opts["dns"], opts["domain"], nil}
+
+	for _, address := range c.Addresses {
+		if _, _, err := net.ParseCIDR(address); err != nil {
+			return c, errors.New("Invalid address: " + address + " (expected ADDRESS/PREFIX, eg. 10.0.0.2/24)")
+		}
+	}
+	for _, ip := range append(append([]string{}, c.Gateways...), c.DNS...) {
+		if net.ParseIP(ip) == nil {
+			return c, errors.New("Invalid IP address: " + ip)
+		}
+	}
+	for _, domain := range c.Domains {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") {
+			return c, errors.New("Invalid domain: " + domain)
+		}
+	}
+	for _, route := range opts["route"] {
+		destination, gateway := route, ""
+		if comma := strings.Index(route, ","); comma >= 0 {
+			destination, gateway = route[:comma], route[comma+1:]
+		}
+		if _, _, err := net.ParseCIDR(destination); err != nil {
+			return c, errors.New("Invalid route destination: " + destination + " (expected ADDRESS/PREFIX)")
+		}
+		if gateway != "" && net.ParseIP(gateway) == nil {
+			return c, errors.New("Invalid route gateway: " + gateway)
+		}
+		c.Routes = append(c.Routes, [2]string{destination, gateway})
+	}
+
+	if len(c.Addresses) == 0 {
+		c.DHCP = true
+	}
+	return c, nil
+}
+
+// Format returns the config in the .network file format.
+func (c NetworkConfig) Format() string {
+	s := "[Match]\nVirtualization=container\nName=host0\n\n[Network]\n"
+	if c.DHCP {
+		s += "DHCP=yes\n"
+	}
+	// Like in 80-container-host0.network.
+	s += "LinkLocalAddressing=yes\n"
+	for _, address := range c.Addresses {
+		s += "Address=" + address + "\n"
+	}
+	for _, gateway := range c.Gateways {
+		s += "Gateway=" + gateway + "\n"
+	}
+	for _, dns := range c.DNS {
+		s += "DNS=" + dns + "\n"
+	}
+	if len(c.Domains) > 0 {
+		s += "Domains=" + strings.Join(c.Domains, " ") + "\n"
+	}
+	for _, route := range c.Routes {
+		s += "\n[Route]\nDestination=" + route[0] + "\n"
+		if route[1] != "" {
+			s += "Gateway=" + route[1] + "\n"
+		}
+	}
+	return s
+}
+
+// Network handles "NETWORK [--dhcp] [--address=ADDRESS/PREFIX]... [--gateway=IP]... [--dns=IP]... [--domain=DOMAIN]... [--route=DESTINATION[,GATEWAY]]...".
+// The config replaces the one written by the previous NETWORK, and systemd-networkd and systemd-resolved are enabled.
+func (b *BuildContext) Network(arg ...string) error {
+	opts, _ := SplitOptions(arg)
+	c, err := ParseNetworkConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	realPath, err := b.ResolvePath(networkConfig)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(realPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(realPath, []byte(c.Format()), 0644); err != nil {
+		return err
+	}
+
+	for _, unit := range []string{"systemd-networkd.service", "systemd-resolved.service"} {
+		if err := b.systemctl(false, "enable", unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package siren
+
+import (
+	"testing"
+)
+
+func TestNetworkConfig(t *testing.T) {
+	opts, _ := SplitOptions([]string{"--address=10.0.0.2/24", "--gateway=10.0.0.1", "--dns=10.0.0.1", "--domain=example.com", "--route=192.168.0.0/16,10.0.0.254"})
+	c, err := ParseNetworkConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[Match]
+Virtualization=container
+Name=host0
+
+[Network]
+LinkLocalAddressing=yes
+Address=10.0.0.2/24
+Gateway=10.0.0.1
+DNS=10.0.0.1
+Domains=example.com
+
+[Route]
+Destination=192.168.0.0/16
+Gateway=10.0.0.254
+`
+	if got := c.Format(); got != want {
+		t.Errorf("Format() == %q, want %q", got, want)
+	}
+
+	if c, err := ParseNetworkConfig(Options{}); err != nil || !c.DHCP {
+		t.Errorf("ParseNetworkConfig() without addresses == %+v, %v, want DHCP", c, err)
+	}
+
+	for _, bad := range []string{"--address=10.0.0.2", "--gateway=gw", "--route=10.0.0.0/8,gw", "--route=default"} {
+		opts, _ := SplitOptions([]string{bad})
+		if _, err := ParseNetworkConfig(opts); err == nil {
+			t.Errorf("ParseNetworkConfig(%v) succeeded", bad)
+		}
+	}
+}
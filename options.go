@@ -0,0 +1,117 @@
+package siren
+
+import (
+	"strings"
+)
+
+// Options given to an instruction as --name=value or --name.
+type Options map[string][]string
+
+// Get returns the last value of the option, or "" if it was not given.
+func (o Options) Get(name string) string {
+	values := o[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (o Options) Has(name string) bool {
+	_, ok := o[name]
+	return ok
+}
+
+// SplitOptions separates the leading --options from the positional arguments.
+// Everything after the first positional argument, or after "--", is positional.
+func SplitOptions(all []string) (Options, []string) {
+	opts := Options{}
+
+	for i, arg := range all {
+		if arg == "--" {
+			return opts, append([]string{}, all[i+1:]...)
+		}
+
+		if !strings.HasPrefix(arg, "--") {
+			return opts, append([]string{}, all[i:]...)
+		}
+
+		name, value := arg[2:], ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		}
+		opts[name] = append(opts[name], value)
+	}
+
+	return opts, []string{}
+}
+
+// splitTrailingOptions is SplitOptions, but the last n arguments are always positional, even if they start with "--".
+func splitTrailingOptions(all []string, n int) (Options, []string) {
+	lead := len(all) - n
+	if lead < 0 {
+		lead = 0
+	}
+	opts, args := SplitOptions(all[:lead])
+	return opts, append(args, all[lead:]...)
+}
+
+// splitArgs separates the options of the instruction from its positional arguments.
+func (def InstructionDef) splitArgs(args []string) (Options, []string) {
+	if def.Options == nil {
+		return Options{}, args
+	}
+	if def.TrailingArgs {
+		return splitTrailingOptions(args, def.MinArgs)
+	}
+	return SplitOptions(args)
+}
+
+// checkOptions verifies that all the options are supported by the instruction.
+// Options taking values are listed in def.Options with the "=" suffix.
+func (def InstructionDef) checkOptions(in Instruction) error {
+	if def.Options == nil {
+		return nil
+	}
+
+	opts := len(in.Args) - 1
+	if def.TrailingArgs {
+		opts -= def.MinArgs
+	}
+
+	for i := 0; i < opts; i++ {
+		arg := in.Args[i+1]
+		if arg == "--" || !strings.HasPrefix(arg, "--") {
+			break
+		}
+
+		name, hasValue := arg[2:], false
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, hasValue = name[:eq], true
+		}
+
+		supported := false
+		for _, opt := range def.Options {
+			if strings.TrimSuffix(opt, "=") != name {
+				continue
+			}
+			supported = true
+			if strings.HasSuffix(opt, "=") != hasValue {
+				if hasValue {
+					return in.Errorf(i+1, "--%v does not take a value.", name)
+				}
+				return in.Errorf(i+1, "--%v requires a value: --%v=VALUE", name, name)
+			}
+		}
+
+		if !supported {
+			return in.Errorf(i+1, "%v does not support the --%v option.", in.Args[0], name)
+		}
+	}
+	return nil
+}
+
+// positionalArgs returns the number of the non-option arguments of the instruction.
+func (def InstructionDef) positionalArgs(in Instruction) int {
+	_, args := def.splitArgs(in.Args[1:])
+	return len(args)
+}
@@ -0,0 +1,49 @@
+package siren
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitOptions(t *testing.T) {
+	cases := []struct {
+		in []string
+		opts Options
+		args []string
+	}{
+		{[]string{"--chown=app", "--preserve-owner", "a", "b/"}, Options{"chown": {"app"}, "preserve-owner": {""}}, []string{"a", "b/"}},
+		{[]string{"a", "--verbose", "b/"}, Options{}, []string{"a", "--verbose", "b/"}},
+		{[]string{"--user", "--", "--weird.service"}, Options{"user": {""}}, []string{"--weird.service"}},
+	}
+	for _, c := range cases {
+		if opts, args := SplitOptions(c.in); !reflect.DeepEqual(opts, c.opts) || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("SplitOptions(%q) == %v, %q, want %v, %q", c.in, opts, args, c.opts, c.args)
+		}
+	}
+}
+
+func TestSetTrailingArgs(t *testing.T) {
+	def, _ := LookupInstruction("SET")
+	cases := []struct {
+		args []string
+		mode string
+		positional []string
+	}{
+		{[]string{"SET", "--mode=0600", "/etc/foo", "bar"}, "0600", []string{"/etc/foo", "bar"}},
+		{[]string{"SET", "/etc/foo", "--verbose"}, "", []string{"/etc/foo", "--verbose"}},
+		{[]string{"SET", "--foo", "bar"}, "", []string{"--foo", "bar"}},
+	}
+	for _, c := range cases {
+		in := Instruction{Args: c.args}
+		if err := def.checkOptions(in); err != nil {
+			t.Errorf("checkOptions(%q) == %v", c.args, err)
+		}
+		if opts, args := def.splitArgs(c.args[1:]); opts.Get("mode") != c.mode || !reflect.DeepEqual(args, c.positional) {
+			t.Errorf("splitArgs(%q) == %v, %q, want --mode=%v, %q", c.args[1:], opts, args, c.mode, c.positional)
+		}
+	}
+
+	if err := def.checkOptions(Instruction{Args: []string{"SET", "--verbose", "/etc/foo", "bar"}}); err == nil {
+		t.Errorf("checkOptions() accepted an unknown option of SET")
+	}
+}
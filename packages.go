@@ -0,0 +1,219 @@
+package siren
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// PackageManager describes how PACKAGE installs packages in a distribution.
+type PackageManager struct {
+	Name string
+	Env []string // KEY=VALUE pairs making the package manager non-interactive.
+
+	// Commands run for PACKAGE, PACKAGE --remove and PACKAGE --upgrade.
+	// The package names are appended to the last command of Install and Remove.
+	Install, Remove, Upgrade [][]string
+
+	// Download cache in the image, bound to /var/lib/siren/cache/NAME - so that it is shared by the builds,
+	// and not stored in the layers. "" - no cache.
+	Cache string
+
+	// Commands run after the others, and paths removed after them - eg. the package lists, downloaded again when needed.
+	// Directories are emptied. The last component of a path can contain wildcards.
+	Cleanup [][]string
+	Clean []string
+}
+
+var pacman = PackageManager{
+	"pacman", nil,
+	// Arch does not support partial upgrades - installing requires upgrading.
+	[][]string{{"pacman", "-Syu", "--noconfirm", "--needed"}},
+	[][]string{{"pacman", "-Rns", "--noconfirm"}},
+	[][]string{{"pacman", "-Syu", "--noconfirm"}},
+	"/var/cache/pacman/pkg",
+	nil,
+	// Synced again by the next -Syu.
+	[]string{"/var/lib/pacman/sync"},
+}
+
+var apt = PackageManager{
+	"apt", []string{"DEBIAN_FRONTEND=noninteractive"},
+	[][]string{{"apt-get", "update"}, {"apt-get", "install", "-y", "--no-install-recommends"}},
+	[][]string{{"apt-get", "remove", "-y", "--purge"}},
+	[][]string{{"apt-get", "update"}, {"apt-get", "dist-upgrade", "-y"}},
+	"/var/cache/apt/archives",
+	nil,
+	[]string{"/var/lib/apt/lists", "/var/cache/apt/*.bin"},
+}
+
+var dnf = PackageManager{
+	"dnf", nil,
+	[][]string{{"dnf", "install", "-y", "--setopt=keepcache=True"}},
+	[][]string{{"dnf", "remove", "-y"}},
+	[][]string{{"dnf", "upgrade", "-y", "--setopt=keepcache=True"}},
+	"/var/cache/dnf",
+	// Only the packages are kept in the cache.
+	[][]string{{"dnf", "clean", "metadata"}},
+	// dnf5 uses its own cache directory.
+	[]string{"/var/cache/libdnf5"},
+}
+
+var zypper = PackageManager{
+	"zypper", nil,
+	[][]string{{"zypper", "--non-interactive", "install", "--no-recommends"}},
+	[][]string{{"zypper", "--non-interactive", "remove", "--clean-deps"}},
+	[][]string{{"zypper", "--non-interactive", "update"}},
+	"/var/cache/zypp/packages",
+	nil,
+	[]string{"/var/cache/zypp/raw", "/var/cache/zypp/solv"},
+}
+
+var apk = PackageManager{
+	"apk", nil,
+	// apk uses a cache only if /etc/apk/cache is set up - --no-cache keeps the indexes out of the layer instead.
+	[][]string{{"apk", "add", "--no-cache"}},
+	[][]string{{"apk", "del", "--no-cache"}},
+	[][]string{{"apk", "upgrade", "--no-cache"}},
+	"",
+	nil,
+	nil,
+}
+
+// Package managers by os-release ID (or ID_LIKE).
+var packageManagers = map[string]PackageManager{
+	"arch": pacman,
+	"debian": apt,
+	"ubuntu": apt,
+	"fedora": dnf,
+	"rhel": dnf,
+	"centos": dnf,
+	"suse": zypper,
+	"opensuse": zypper,
+	"alpine": apk,
+}
+
+// DetectPackageManager finds the package manager of the distribution, by its ID, and then by its ID_LIKE.
+func DetectPackageManager(osRelease map[string]string) (PackageManager, error) {
+	ids := append([]string{osRelease["ID"]}, strings.Fields(osRelease["ID_LIKE"])...)
+	for _, id := range ids {
+		if pm, ok := packageManagers[id]; ok {
+			return pm, nil
+		}
+	}
+	if osRelease["ID"] == "" {
+		return PackageManager{}, errors.New("The image has no os-release - can't detect the package manager.")
+	}
+	return PackageManager{}, errors.New("Unsupported distribution: " + osRelease["ID"] + " - use RUN with its package manager.")
+}
+
+// Package handles "PACKAGE NAME...", "PACKAGE --remove NAME..." and "PACKAGE --upgrade [NAME...]".
+// The commands are run as root, regardless of USER.
+func (b *BuildContext) Package(arg ...string) error {
+	opts, names := SplitOptions(arg)
+	if len(names) == 0 && !opts.Has("upgrade") {
+		return errors.New("PACKAGE requires package names, unless --upgrade is used.")
+	}
+
+	osRelease, err := b.readOSRelease()
+	if err != nil {
+		return err
+	}
+	pm, err := DetectPackageManager(osRelease)
+	if err != nil {
+		return err
+	}
+
+	cmdOpts := imagectl.CommandOptions{Env: append(append([]string{}, b.Env...), pm.Env...), WorkDir: "/"}
+	if pm.Cache != "" {
+		bind, err := cacheBind(pm.Name, pm.Cache)
+		if err != nil {
+			return err
+		}
+		cmdOpts.Binds = []string{bind}
+	}
+
+	var commands [][]string
+	switch {
+		case opts.Has("remove"):
+			commands = withPackages(pm.Remove, names)
+		case opts.Has("upgrade"):
+			commands = append([][]string{}, pm.Upgrade...)
+			if len(names) > 0 {
+				commands = append(commands, withPackages(pm.Install, names)...)
+			}
+		default:
+			commands = withPackages(pm.Install, names)
+	}
+
+	for _, c := range append(commands, pm.Cleanup...) {
+		if err := b.Task.RunCmd(imagectl.ImageCommandWithOptions(b.Image, cmdOpts, c[0], c[1:]...)); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range pm.Clean {
+		if err := b.cleanPath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withPackages appends the package names to the last command.
+func withPackages(commands [][]string, names []string) [][]string {
+	res := make([][]string, len(commands))
+	copy(res, commands)
+	last := len(res) - 1
+	res[last] = append(append([]string{}, res[last]...), names...)
+	return res
+}
+
+// cleanPath empties the directory in the image, or removes the files matching the pattern,
+// if it has wildcards in the last component.
+func (b *BuildContext) cleanPath(p string) error {
+	if !hasGlobMeta(path.Base(p)) {
+		return b.emptyDir(p)
+	}
+
+	realDir, err := b.ResolvePath(path.Dir(p))
+	if err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(filepath.Join(realDir, path.Base(p)))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := os.RemoveAll(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyDir removes the content of the directory in the image, if it exists.
+func (b *BuildContext) emptyDir(dir string) error {
+	realPath, err := b.ResolvePath(dir)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(realPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(realPath, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
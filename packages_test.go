@@ -0,0 +1,76 @@
+package siren
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectPackageManager(t *testing.T) {
+	cases := []struct {
+		osRelease map[string]string
+		want string
+	}{
+		{map[string]string{"ID": "arch"}, "pacman"},
+		{map[string]string{"ID": "linuxmint", "ID_LIKE": "ubuntu debian"}, "apt"},
+		{map[string]string{"ID": "rocky", "ID_LIKE": "rhel centos fedora"}, "dnf"},
+		{map[string]string{"ID": "opensuse-tumbleweed", "ID_LIKE": "opensuse suse"}, "zypper"},
+	}
+	for _, c := range cases {
+		if pm, err := DetectPackageManager(c.osRelease); err != nil || pm.Name != c.want {
+			t.Errorf("DetectPackageManager(%v) == %v, %v, want %v", c.osRelease, pm.Name, err, c.want)
+		}
+	}
+
+	for _, osRelease := range []map[string]string{{}, {"ID": "gentoo"}} {
+		if _, err := DetectPackageManager(osRelease); err == nil {
+			t.Errorf("DetectPackageManager(%v) succeeded", osRelease)
+		}
+	}
+}
+
+func TestWithPackages(t *testing.T) {
+	want := [][]string{{"apt-get", "update"}, {"apt-get", "install", "-y", "--no-install-recommends", "nginx", "curl"}}
+	if got := withPackages(apt.Install, []string{"nginx", "curl"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("withPackages() == %q, want %q", got, want)
+	}
+	if len(apt.Install[1]) != 4 {
+		t.Errorf("withPackages() changed the original command: %q", apt.Install[1])
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-packages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := NewBuildContext(nil, "", nil)
+	b.Image = testImage{nil, "test", dir}
+
+	files := []string{"var/lib/apt/lists/deb_Packages", "var/cache/apt/pkgcache.bin", "var/cache/apt/srcpkgcache.bin", "var/cache/apt/archives/lock"}
+	for _, name := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	for _, p := range append(apt.Clean, "/var/cache/missing/*.bin", "/var/lib/missing") {
+		if err := b.cleanPath(p); err != nil {
+			t.Errorf("cleanPath(%q) == %v", p, err)
+		}
+	}
+
+	for _, name := range files[:3] {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%v was not removed", name)
+		}
+	}
+	for _, name := range []string{"var/lib/apt/lists", files[3]} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%v was removed", name)
+		}
+	}
+}
@@ -1,15 +1,24 @@
-package main
+package siren
 
 import (
-	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 )
 
 func ParseLine(line string) ([]string, error) {
+	parts, _, err := parseLine(line)
+	return parts, err
+}
+
+// parseLine returns the parts of the line, and the columns they start at.
+func parseLine(line string) ([]string, []int, error) {
 	parts := make([]string, 0, strings.Count(line, " "))
+	columns := make([]int, 0, cap(parts))
 
 	part := make([]rune, 0, len(line))
+	partStart := 0
 
 	i := 0
 
@@ -17,6 +26,7 @@ func ParseLine(line string) ([]string, error) {
 		r, d := utf8.DecodeRuneInString(line[i:])
 		switch r {
 			case '"':
+				quoteStart := i
 				i += d
 
 				endFound := false
@@ -39,10 +49,11 @@ func ParseLine(line string) ([]string, error) {
 					}
 				}
 				if !endFound {
-					return nil, errors.New("Invalid line.")
+					return nil, nil, &ParseError{"", 0, column(line, quoteStart), line, "Unterminated double quote."}
 				}
 
 			case '\'':
+				quoteStart := i
 				i += d
 
 				endFound := false
@@ -59,13 +70,15 @@ func ParseLine(line string) ([]string, error) {
 					}
 				}
 				if !endFound {
-					return nil, errors.New("Invalid line.")
+					return nil, nil, &ParseError{"", 0, column(line, quoteStart), line, "Unterminated single quote."}
 				}
 
 			case ' ':
 				parts = append(parts, string(part))
+				columns = append(columns, column(line, partStart))
 				part = make([]rune, 0, len(line)-i)
 				i += d
+				partStart = i
 
 			case '\\':
 				i += d
@@ -80,23 +93,190 @@ func ParseLine(line string) ([]string, error) {
 	}
 
 	parts = append(parts, string(part))
-	return parts, nil
+	columns = append(columns, column(line, partStart))
+	return parts, columns, nil
+}
+
+// column converts a byte offset in the line to a 1-based column number.
+func column(line string, offset int) int {
+	return utf8.RuneCountInString(line[:offset]) + 1
+}
+
+// ParseError describes a problem at a specific place of a Sirenfile.
+type ParseError struct {
+	File string
+	Line, Column int // 1-based. 0 if unknown.
+	Text string // The line, shown with a caret pointing at the column.
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		loc += ":" + strconv.Itoa(e.Line)
+		if e.Column > 0 {
+			loc += ":" + strconv.Itoa(e.Column)
+		}
+	}
+
+	msg := loc + ": " + e.Message
+	if e.Text != "" {
+		msg += "\n" + e.Text
+		if e.Column > 0 {
+			// Keep the tabs, so that the caret is aligned with the text above it.
+			caret := []rune{}
+			for i, r := range []rune(e.Text) {
+				if i >= e.Column-1 {
+					break
+				}
+				if r == '\t' {
+					caret = append(caret, '\t')
+				} else {
+					caret = append(caret, ' ')
+				}
+			}
+			msg += "\n" + string(caret) + "^"
+		}
+	}
+	return msg
+}
+
+type Instruction struct {
+	Line int // 1-based line number in the Sirenfile.
+	Args []string
+	Body string // Content of the heredoc, if the last argument is <<WORD, or of the block of a Block instruction.
+
+	File string // Path of the Sirenfile.
+	Text string // The line, with its continuation lines joined.
+	Columns []int // 1-based columns of Args in Text.
+}
+
+// Errorf creates a ParseError pointing at the given argument (0 - the instruction name).
+func (in Instruction) Errorf(arg int, format string, a ...interface{}) *ParseError {
+	col := 0
+	if arg < len(in.Columns) {
+		col = in.Columns[arg]
+	}
+	return &ParseError{in.File, in.Line, col, in.Text, fmt.Sprintf(format, a...)}
+}
+
+// Warnf is like Errorf, but creates a Warning.
+func (in Instruction) Warnf(arg int, format string, a ...interface{}) Warning {
+	return Warning{in.Errorf(arg, format, a...)}
+}
+
+func isHeredoc(arg string) bool {
+	return strings.HasPrefix(arg, "<<") && len(arg) > 2
+}
+
+// hasContinuation checks if the line ends with an unescaped backslash.
+func hasContinuation(line string) bool {
+	backslashes := len(line) - len(strings.TrimRight(line, "\\"))
+	return backslashes % 2 == 1
 }
 
-func ParseSirenfile(file string) ([][]string, error) {
+// ParseSirenfile parses the content of the Sirenfile at path.
+// All the returned errors are *ParseError.
+func ParseSirenfile(path, file string) ([]Instruction, error) {
+	instructions, errs := parseSirenfile(path, file)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return instructions, nil
+}
+
+// parseSirenfile skips the invalid instructions, and returns all the errors found.
+func parseSirenfile(path, file string) ([]Instruction, []error) {
+	errs := []error{}
+
 	lines := strings.Split(file, "\n")
 
-	commands := make([][]string, 0, len(lines))
+	instructions := make([]Instruction, 0, len(lines))
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" || line[0] == '#' || line[0] == '.' {
+			continue
+		}
+
+		start := i + 1
+
+		for hasContinuation(line) {
+			if i+1 >= len(lines) {
+				errs = append(errs, &ParseError{path, start, len([]rune(lines[start-1])), lines[start-1], "The last line ends with a backslash."})
+				return instructions, errs
+			}
+
+			i++
+			next := strings.TrimLeft(lines[i], " \t")
+			if strings.HasPrefix(next, "#") {
+				// Comments are allowed between continuation lines.
+				continue
+			}
+
+			line = strings.TrimRight(line[:len(line)-1], " \t")
+			if next != "" {
+				line += " " + next
+			}
+		}
+
+		parts, columns, err := parseLine(line)
+		if err != nil {
+			err := err.(*ParseError)
+			err.File, err.Line = path, start
+			errs = append(errs, err)
+			continue
+		}
+
+		in := Instruction{start, parts, "", path, line, columns}
+
+		def, known := LookupInstruction(parts[0])
+
+		body := ""
+		last := parts[len(parts)-1]
+		delimiter, stripTabs := "", false
+		switch {
+			case isHeredoc(last):
+				// <<-WORD strips leading tabs, like in the shell.
+				stripTabs = strings.HasPrefix(last, "<<-")
+				delimiter = strings.TrimPrefix(strings.TrimPrefix(last, "<<"), "-")
+			case def.Block:
+				delimiter = "END"
+		}
+
+		if delimiter != "" {
+			endFound := false
+			for !endFound && i+1 < len(lines) {
+				i++
+				bodyLine := lines[i]
+				if stripTabs {
+					bodyLine = strings.TrimLeft(bodyLine, "\t")
+				}
 
-	for _, line := range lines {
-		if line != "" && line[0] != '#' && line[0] != '.' {
-			parts, err := ParseLine(line)
-			if err != nil {
-				return nil, err
+				if bodyLine == delimiter {
+					endFound = true
+				} else {
+					body += bodyLine + "\n"
+				}
+			}
+			if !endFound && !isHeredoc(last) {
+				errs = append(errs, in.Errorf(0, "%v is not terminated with END.", parts[0]))
+				return instructions, errs
+			}
+			if !endFound {
+				errs = append(errs, in.Errorf(len(parts)-1, "Heredoc is not terminated with %v.", delimiter))
+				return instructions, errs
 			}
-			commands = append(commands, parts)
 		}
+
+		if !known {
+			errs = append(errs, in.Errorf(0, "Unknown instruction: %v", parts[0]))
+			continue
+		}
+
+		in.Body = body
+		instructions = append(instructions, in)
 	}
 
-	return commands, nil
+	return instructions, errs
 }
@@ -1,6 +1,11 @@
-package main
+package siren
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"reflect"
 )
@@ -23,3 +28,172 @@ func TestParseLine(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandVariables(t *testing.T) {
+	in := []Instruction{
+		{Line: 1, Args: []string{"ARG", "VERSION", "1.0"}},
+		{Line: 2, Args: []string{"ARG", "MIRROR=http://example.com"}},
+		{Line: 3, Args: []string{"ID", "app", "${VERSION}"}},
+		{Line: 4, Args: []string{"RUN", "curl", "${MIRROR}/app-${VERSION}.tar", "$${HOME}"}},
+		{Line: 5, Args: []string{"RUN", "sh", "-c", "echo ${HOME} ${PATH:-/bin} ${"}},
+	}
+	want := []Instruction{
+		{Line: 3, Args: []string{"ID", "app", "2.0"}},
+		{Line: 4, Args: []string{"RUN", "curl", "http://example.com/app-2.0.tar", "${HOME}"}},
+		{Line: 5, Args: []string{"RUN", "sh", "-c", "echo ${HOME} ${PATH:-/bin} ${"}},
+	}
+
+	got, err := ExpandVariables(in, map[string]string{"VERSION": "2.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpandVariables() == %q, want %q", got, want)
+	}
+
+	unset := []Instruction{
+		{Line: 1, Args: []string{"ARG", "VERSION"}},
+		{Line: 2, Args: []string{"ID", "app", "${VERSION}"}},
+	}
+	if _, err := ExpandVariables(unset, nil); err == nil {
+		t.Errorf("ExpandVariables() accepted an unset build argument")
+	}
+}
+
+func TestUndeclaredVariables(t *testing.T) {
+	in := []Instruction{
+		{File: "Sirenfile", Line: 1, Args: []string{"ARG", "VERSION", "1.0"}, Columns: []int{1, 5, 13}},
+		{File: "Sirenfile", Line: 2, Args: []string{"ID", "app", "${VERSON}"}, Columns: []int{1, 4, 8}},
+		{File: "Sirenfile", Line: 3, Args: []string{"RUN", "sh", "-c", "echo $${HOME} ${PATH:-/bin} ${VERSION}"}, Columns: []int{1, 5, 8, 11}},
+	}
+
+	_, _, warnings, err := expandInstructions(in, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expandInstructions() warnings == %q, want one about ${VERSON}", warnings)
+	}
+	if !IsWarning(warnings[0]) || !strings.HasPrefix(warnings[0].Error(), "Sirenfile:2:8: ${VERSON} ") {
+		t.Errorf("expandInstructions() warning == %q, want a Warning about ${VERSON} at Sirenfile:2:8", warnings[0])
+	}
+}
+
+func TestParseSirenfile(t *testing.T) {
+	in := `ID app
+RUN pacman -S --noconfirm \
+	# Web server
+	nginx \
+	python
+RUN <<EOF
+set -x
+echo "${HOME}"
+EOF
+SHELL /bin/bash -c
+SERVICE --enable app
+[Service]
+ExecStart=/usr/bin/app
+END
+`
+	want := []Instruction{
+		{Line: 1, Args: []string{"ID", "app"}},
+		{Line: 2, Args: []string{"RUN", "pacman", "-S", "--noconfirm", "nginx", "python"}},
+		{Line: 6, Args: []string{"RUN", "<<EOF"}, Body: "set -x\necho \"${HOME}\"\n"},
+		{Line: 10, Args: []string{"SHELL", "/bin/bash", "-c"}},
+		{Line: 11, Args: []string{"SERVICE", "--enable", "app"}, Body: "[Service]\nExecStart=/usr/bin/app\n"},
+	}
+
+	got, err := ParseSirenfile("Sirenfile", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i].File, got[i].Text, got[i].Columns = "", "", nil
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseSirenfile() == %q, want %q", got, want)
+	}
+
+	if _, err := ParseSirenfile("Sirenfile", "RUN <<EOF\necho\n"); err == nil {
+		t.Errorf("ParseSirenfile() accepted an unterminated heredoc")
+	}
+	if _, err := ParseSirenfile("Sirenfile", "SERVICE app\n[Service]\n"); err == nil {
+		t.Errorf("ParseSirenfile() accepted an unterminated block")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	cases := []struct {
+		in string; want string
+	}{
+		{"ID app\nRUN echo 'abc", "Sirenfile:2:10: Unterminated single quote.\nRUN echo 'abc\n         ^"},
+		{"ID app\n\nRUM echo", "Sirenfile:3:1: Unknown instruction: RUM\nRUM echo\n^"},
+	}
+	for _, c := range cases {
+		_, err := ParseSirenfile("Sirenfile", c.in)
+		if err == nil || err.Error() != c.want {
+			t.Errorf("ParseSirenfile(%q) error == %q, want %q", c.in, err, c.want)
+		}
+	}
+}
+
+func TestSplitStages(t *testing.T) {
+	in := `STAGE build
+FROM toolchain
+RUN make
+ID app
+FROM runtime
+COPY --from=build /out/app /usr/bin/
+`
+	instructions, err := ParseSirenfile("Sirenfile", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stages, commands := SplitStages(instructions)
+	if len(stages) != 1 || stages[0].Name != "build" || stages[0].BaseName != "toolchain" || len(stages[0].Commands) != 1 || stages[0].Commands[0].Args[0] != "RUN" {
+		t.Errorf("SplitStages() stages == %+v", stages)
+	}
+	if len(commands) != 3 || commands[0].Args[0] != "ID" || commands[2].Args[0] != "COPY" {
+		t.Errorf("SplitStages() commands == %+v", commands)
+	}
+}
+
+func TestResolveIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "common.siren"), []byte("RUN locale-gen\nINCLUDE time.siren\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "time.siren"), []byte("SET /etc/timezone UTC\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "loop.siren"), []byte("INCLUDE loop.siren\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "broken.siren"), []byte("RUM\n"), 0644)
+
+	instructions, _ := ParseSirenfile(dir + "/Sirenfile", "ID app\nINCLUDE common.siren\nRUN true\n")
+	got, err := ResolveIncludes(dir, instructions, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{{"ID", "app"}, {"RUN", "locale-gen"}, {"SET", "/etc/timezone", "UTC"}, {"RUN", "true"}}
+	if len(got) != len(want) {
+		t.Fatalf("ResolveIncludes() == %v, want %v", got, want)
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i].Args, want[i]) {
+			t.Errorf("ResolveIncludes()[%v] == %q, want %q", i, got[i].Args, want[i])
+		}
+	}
+	if got[2].File != filepath.Join(dir, "time.siren") || got[2].Line != 1 {
+		t.Errorf("ResolveIncludes()[2] location == %v:%v, want %v:1", got[2].File, got[2].Line, filepath.Join(dir, "time.siren"))
+	}
+
+	for _, file := range []string{"loop.siren", "broken.siren", "missing.siren", "../escape.siren"} {
+		instructions, _ := ParseSirenfile(dir + "/Sirenfile", "INCLUDE " + file)
+		if _, err := ResolveIncludes(dir, instructions, &bytes.Buffer{}); err == nil {
+			t.Errorf("ResolveIncludes() of %v succeeded", file)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package siren
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Unified diffs are applied in-process, so that PATCH works also in images without patch.
+
+// FilePatch is the part of a unified diff changing a single file.
+type FilePatch struct {
+	OldName, NewName string // "/dev/null" for created and removed files.
+	Hunks []Hunk
+}
+
+// Hunk is a single "@@ -OLD_START,OLD_LINES +NEW_START,NEW_LINES @@" block.
+type Hunk struct {
+	OldStart, NewStart int
+	Lines []HunkLine
+}
+
+// HunkLine is a context (' '), removed ('-') or added ('+') line. Text includes the "\n", unless
+// it is the last line of a file without a newline at the end.
+type HunkLine struct {
+	Op byte
+	Text string
+}
+
+func (h Hunk) Header() string {
+	oldLines, newLines := 0, 0
+	for _, l := range h.Lines {
+		if l.Op != '+' {
+			oldLines++
+		}
+		if l.Op != '-' {
+			newLines++
+		}
+	}
+	return "@@ -" + strconv.Itoa(h.OldStart) + "," + strconv.Itoa(oldLines) + " +" + strconv.Itoa(h.NewStart) + "," + strconv.Itoa(newLines) + " @@"
+}
+
+func (h Hunk) String() string {
+	s := h.Header() + "\n"
+	for _, l := range h.Lines {
+		s += string(l.Op) + l.Text
+		if !strings.HasSuffix(l.Text, "\n") {
+			s += "\n\\ No newline at end of file\n"
+		}
+	}
+	return s
+}
+
+// Reverse returns the patch undoing p.
+func (p FilePatch) Reverse() FilePatch {
+	r := FilePatch{p.NewName, p.OldName, make([]Hunk, len(p.Hunks))}
+	for i, h := range p.Hunks {
+		lines := make([]HunkLine, len(h.Lines))
+		for j, l := range h.Lines {
+			switch l.Op {
+				case '-':
+					l.Op = '+'
+				case '+':
+					l.Op = '-'
+			}
+			lines[j] = l
+		}
+		r.Hunks[i] = Hunk{h.NewStart, h.OldStart, lines}
+	}
+	return r
+}
+
+// ParsePatch parses a unified diff (as produced by diff -u and git diff). Lines outside of the file patches
+// (eg. "diff --git" and "index" lines, or a commit message) are ignored.
+func ParsePatch(diff string) ([]FilePatch, error) {
+	lines := strings.SplitAfter(diff, "\n")
+	patches := []FilePatch{}
+
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") || i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+
+		p := FilePatch{patchFileName(lines[i]), patchFileName(lines[i+1]), nil}
+		i += 2
+
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			h, oldLines, newLines, err := parseHunkHeader(lines[i])
+			if err != nil {
+				return nil, errors.New("Line " + strconv.Itoa(i+1) + ": " + err.Error())
+			}
+			i++
+
+			for oldLines > 0 || newLines > 0 {
+				if i >= len(lines) || lines[i] == "" {
+					return nil, errors.New("Line " + strconv.Itoa(i+1) + ": Unexpected end of the hunk.")
+				}
+
+				line := lines[i]
+				op, text := line[0], line[1:]
+				if line == "\n" {
+					// Some editors strip the trailing whitespace of empty context lines.
+					op, text = ' ', "\n"
+				}
+
+				switch op {
+					case ' ':
+						oldLines--
+						newLines--
+					case '-':
+						oldLines--
+					case '+':
+						newLines--
+					default:
+						return nil, errors.New("Line " + strconv.Itoa(i+1) + ": Unexpected line in the hunk: " + strings.TrimSuffix(line, "\n"))
+				}
+				if oldLines < 0 || newLines < 0 {
+					return nil, errors.New("Line " + strconv.Itoa(i+1) + ": The hunk is longer than its header says.")
+				}
+				h.Lines = append(h.Lines, HunkLine{op, text})
+				i++
+
+				if i < len(lines) && strings.HasPrefix(lines[i], "\\") {
+					// "\ No newline at end of file" applies to the previous line.
+					last := &h.Lines[len(h.Lines)-1]
+					last.Text = strings.TrimSuffix(last.Text, "\n")
+					i++
+				}
+			}
+
+			p.Hunks = append(p.Hunks, h)
+		}
+		// Compensate for the i++ of the loop.
+		i--
+
+		patches = append(patches, p)
+	}
+
+	if len(patches) == 0 {
+		return nil, errors.New("No file patches found - expected a unified diff.")
+	}
+	return patches, nil
+}
+
+// patchFileName returns the file name of a "--- NAME" or "+++ NAME" line, without the timestamp.
+func patchFileName(line string) string {
+	name := strings.TrimSuffix(line[4:], "\n")
+	if tab := strings.Index(name, "\t"); tab >= 0 {
+		name = name[:tab]
+	}
+	return strings.TrimSpace(name)
+}
+
+func parseHunkHeader(line string) (h Hunk, oldLines, newLines int, err error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[3] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return Hunk{}, 0, 0, errors.New("Invalid hunk header: " + strings.TrimSuffix(line, "\n"))
+	}
+
+	if h.OldStart, oldLines, err = parseRange(fields[1][1:]); err != nil {
+		return Hunk{}, 0, 0, errors.New("Invalid hunk header: " + strings.TrimSuffix(line, "\n"))
+	}
+	if h.NewStart, newLines, err = parseRange(fields[2][1:]); err != nil {
+		return Hunk{}, 0, 0, errors.New("Invalid hunk header: " + strings.TrimSuffix(line, "\n"))
+	}
+	return h, oldLines, newLines, nil
+}
+
+// parseRange parses "START[,LINES]". LINES is 1 by default.
+func parseRange(r string) (start, lines int, err error) {
+	lines = 1
+	if comma := strings.Index(r, ","); comma >= 0 {
+		if lines, err = strconv.Atoi(r[comma+1:]); err != nil {
+			return
+		}
+		r = r[:comma]
+	}
+	start, err = strconv.Atoi(r)
+	return
+}
+
+// StripPath removes n leading components from the path of the patched file, like patch -p.
+func StripPath(name string, n int) (string, error) {
+	stripped := name
+	for i := 0; i < n; i++ {
+		slash := strings.Index(stripped, "/")
+		if slash < 0 {
+			return "", errors.New("Can't strip " + strconv.Itoa(n) + " components from " + name + ".")
+		}
+		stripped = stripped[slash+1:]
+	}
+	return stripped, nil
+}
+
+// ApplyHunks applies the hunks to the content. Hunks that moved are found by searching the content,
+// nearest to the line given in their header first. With fuzz > 0, up to fuzz context lines at
+// the beginning and at the end of the hunk are ignored if the hunk doesn't match otherwise.
+func ApplyHunks(content string, hunks []Hunk, fuzz int) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	result := []string{}
+	pos := 0 // Lines before pos are already in result.
+	offset := 0 // How much the previous hunk moved.
+
+	for n, h := range hunks {
+		found := false
+		for f := 0; f <= fuzz && !found; f++ {
+			oldText, newText, trimmed := h.trimContext(f)
+			if f > 0 && trimmed == 0 && len(oldText) == len(hunkText(h.Lines, '+')) {
+				// Nothing to trim.
+				continue
+			}
+
+			// The line of the header, or the one after it if the hunk only adds lines.
+			start := h.OldStart - 1
+			if len(hunkText(h.Lines, '+')) == 0 {
+				start = h.OldStart
+			}
+
+			at := findLines(lines, oldText, pos, start + trimmed + offset)
+			if at < 0 {
+				continue
+			}
+
+			result = append(append(result, lines[pos:at]...), newText...)
+			offset = at - trimmed - start
+			pos = at + len(oldText)
+			found = true
+		}
+
+		if !found {
+			return "", errors.New("Hunk #" + strconv.Itoa(n+1) + " does not apply:\n" + h.String())
+		}
+	}
+
+	return strings.Join(append(result, lines[pos:]...), ""), nil
+}
+
+// trimContext returns the old and the new lines of the hunk, without up to n context lines at both ends,
+// and the number of the lines trimmed at the beginning.
+func (h Hunk) trimContext(n int) (oldText, newText []string, trimmed int) {
+	lines := h.Lines
+	for trimmed < n && len(lines) > 0 && lines[0].Op == ' ' {
+		lines = lines[1:]
+		trimmed++
+	}
+	for i := 0; i < n && len(lines) > 0 && lines[len(lines)-1].Op == ' '; i++ {
+		lines = lines[:len(lines)-1]
+	}
+	return hunkText(lines, '+'), hunkText(lines, '-'), trimmed
+}
+
+// hunkText returns the text of the lines, skipping the ones with the given op.
+func hunkText(lines []HunkLine, skip byte) []string {
+	text := []string{}
+	for _, l := range lines {
+		if l.Op != skip {
+			text = append(text, l.Text)
+		}
+	}
+	return text
+}
+
+// findLines finds the position of want in lines (not before min), closest to expected.
+func findLines(lines, want []string, min, expected int) int {
+	if expected < min {
+		expected = min
+	}
+	for d := 0; expected-d >= min || expected+d <= len(lines) - len(want); d++ {
+		for _, at := range []int{expected - d, expected + d} {
+			if at >= min && at <= len(lines) - len(want) && linesEqual(lines[at:at+len(want)], want) {
+				return at
+			}
+		}
+	}
+	return -1
+}
+
+func linesEqual(a, b []string) bool {
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Patch handles "PATCH [--strip=N] [--fuzz=N] [--reverse] DIFF...".
+// The paths in the diffs are relative to WORKDIR, after stripping N components (1 by default, like in git diffs).
+// Nothing is changed unless all the hunks apply.
+func (b *BuildContext) Patch(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+
+	strip, fuzz, err := patchOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	type change struct {
+		content string
+		remove bool
+	}
+	// By the real paths - the later diffs patch the results of the earlier ones.
+	changes := map[string]*change{}
+	order := []string{}
+
+	for _, diffName := range arg {
+		diffPath, err := b.RealPath(diffName)
+		if err != nil {
+			return err
+		}
+		diff, err := ioutil.ReadFile(diffPath)
+		if err != nil {
+			return err
+		}
+		patches, err := ParsePatch(string(diff))
+		if err != nil {
+			return errors.New(diffName + ": " + err.Error())
+		}
+
+		for _, p := range patches {
+			if opts.Has("reverse") {
+				p = p.Reverse()
+			}
+
+			name := p.NewName
+			if name == "/dev/null" {
+				name = p.OldName
+			}
+			if name, err = StripPath(name, strip); err != nil {
+				return errors.New(diffName + ": " + err.Error())
+			}
+			realPath, err := b.ResolvePath(name)
+			if err != nil {
+				return err
+			}
+
+			content := ""
+			pending, isPending := changes[realPath]
+			exists := isPending && !pending.remove
+			if isPending {
+				content = pending.content
+			} else if _, err := os.Lstat(realPath); err == nil {
+				exists = true
+			}
+
+			switch {
+				case p.OldName == "/dev/null" && exists:
+					return errors.New(diffName + ": " + name + " already exists, but the patch creates it.")
+				case p.OldName != "/dev/null" && isPending && !exists:
+					return errors.New(diffName + ": " + name + " is removed by an earlier patch.")
+				case p.OldName != "/dev/null" && !isPending:
+					c, err := ioutil.ReadFile(realPath)
+					if err != nil {
+						return err
+					}
+					content = string(c)
+			}
+
+			patched, err := ApplyHunks(content, p.Hunks, fuzz)
+			if err != nil {
+				return errors.New(diffName + ": " + name + ": " + err.Error())
+			}
+
+			remove := p.NewName == "/dev/null"
+			if remove && patched != "" {
+				return errors.New(diffName + ": " + name + " is not empty after removing the content of the patch.")
+			}
+			if !isPending {
+				order = append(order, realPath)
+			}
+			changes[realPath] = &change{patched, remove}
+		}
+	}
+
+	for _, path := range order {
+		c := changes[path]
+		if c.remove {
+			if err := removeExisting(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Existing files keep their modes and owners.
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func patchOptions(opts Options) (strip, fuzz int, err error) {
+	strip = 1
+	if s := opts.Get("strip"); s != "" {
+		if strip, err = strconv.Atoi(s); err != nil || strip < 0 {
+			return 0, 0, errors.New("Invalid --strip: " + s + " (expected a number of path components)")
+		}
+	}
+	if f := opts.Get("fuzz"); f != "" {
+		if fuzz, err = strconv.Atoi(f); err != nil || fuzz < 0 {
+			return 0, 0, errors.New("Invalid --fuzz: " + f + " (expected a number of context lines)")
+		}
+	}
+	return strip, fuzz, nil
+}
@@ -0,0 +1,110 @@
+package siren
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDiff = `diff --git a/etc/pacman.conf b/etc/pacman.conf
+index 1234567..89abcde 100644
+--- a/etc/pacman.conf
++++ b/etc/pacman.conf
+@@ -2,3 +2,3 @@
+ RootDir = /
+-#Color
++Color
+ CheckSpace
+@@ -7,2 +7,3 @@
+ [core]
+ Include = /etc/pacman.d/mirrorlist
++
+`
+
+const pacmanConf = `[options]
+RootDir = /
+#Color
+CheckSpace
+ParallelDownloads = 5
+
+[core]
+Include = /etc/pacman.d/mirrorlist
+`
+
+func TestApplyPatch(t *testing.T) {
+	patches, err := ParsePatch(testDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 1 || patches[0].NewName != "b/etc/pacman.conf" || len(patches[0].Hunks) != 2 {
+		t.Fatalf("ParsePatch() == %+v", patches)
+	}
+
+	want := "[options]\nRootDir = /\nColor\nCheckSpace\nParallelDownloads = 5\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n\n"
+	if got, err := ApplyHunks(pacmanConf, patches[0].Hunks, 0); err != nil || got != want {
+		t.Errorf("ApplyHunks() == %q, %v, want %q", got, err, want)
+	}
+
+	// Moved by a line.
+	if got, err := ApplyHunks("# pacman.conf\n" + pacmanConf, patches[0].Hunks, 0); err != nil || got != "# pacman.conf\n" + want {
+		t.Errorf("ApplyHunks() of a moved hunk == %q, %v", got, err)
+	}
+
+	reversed := patches[0].Reverse()
+	if got, err := ApplyHunks(want, reversed.Hunks, 0); err != nil || got != pacmanConf {
+		t.Errorf("ApplyHunks() of the reversed patch == %q, %v, want %q", got, err, pacmanConf)
+	}
+
+	// The context line before #Color doesn't match.
+	changed := "[options]\nRootDir = /mnt\n#Color\nCheckSpace\nParallelDownloads = 5\n\n[core]\nInclude = /etc/pacman.d/mirrorlist\n"
+	if _, err := ApplyHunks(changed, patches[0].Hunks, 0); err == nil {
+		t.Errorf("ApplyHunks() with a mismatched context succeeded")
+	}
+	if _, err := ApplyHunks(changed, patches[0].Hunks, 1); err != nil {
+		t.Errorf("ApplyHunks() with fuzz 1 == %v", err)
+	}
+}
+
+func TestApplyPatchNoNewline(t *testing.T) {
+	patches, err := ParsePatch("--- /dev/null\n+++ b/motd\n@@ -0,0 +1,2 @@\n+Hello\n+World\n\\ No newline at end of file\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplyHunks("", patches[0].Hunks, 0); err != nil || got != "Hello\nWorld" {
+		t.Errorf("ApplyHunks() == %q, %v, want %q", got, err, "Hello\nWorld")
+	}
+
+	if _, err := ParsePatch("--- a/motd\n+++ b/motd\n@@ -1,2 +1,2 @@\n Hello\n"); err == nil {
+		t.Errorf("ParsePatch() accepted a truncated hunk")
+	}
+}
+
+func TestPatchNewFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	buildDir, imageDir := filepath.Join(dir, "build"), filepath.Join(dir, "image")
+	os.MkdirAll(buildDir, 0755)
+	os.MkdirAll(imageDir, 0755)
+	ioutil.WriteFile(filepath.Join(buildDir, "create.diff"), []byte("--- /dev/null\n+++ b/etc/app/conf.d/app.conf\n@@ -0,0 +1,2 @@\n+a\n+b\n"), 0644)
+	ioutil.WriteFile(filepath.Join(buildDir, "change.diff"), []byte("--- a/etc/app/conf.d/app.conf\n+++ b/etc/app/conf.d/app.conf\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"), 0644)
+
+	b := NewBuildContext(nil, buildDir, nil)
+	b.Image = testImage{nil, "test", imageDir}
+
+	// Both in a single PATCH - the second diff changes the file created by the first one, in a new directory.
+	if err := b.Patch("create.diff", "change.diff"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(imageDir, "etc/app/conf.d/app.conf")); err != nil || string(content) != "a\nc\n" {
+		t.Errorf("app.conf == %q, %v, want %q", content, err, "a\nc\n")
+	}
+
+	if err := b.Patch("create.diff"); err == nil {
+		t.Errorf("Patch() created an existing file")
+	}
+}
@@ -0,0 +1,62 @@
+package siren
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// resolveInside returns the real path of name inside root (eg. the build directory).
+// Symlinks in its parent directories are followed only if they are relative, and stay inside root.
+// The last component is not followed.
+func resolveInside(root, name string) (string, error) {
+	if clean := filepath.Clean(name); clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errors.New(name + ": The path leads outside of " + root + ".")
+	}
+
+	parts := strings.Split(name, "/")
+	pending := parts[:len(parts)-1]
+	resolved := []string{}
+
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+
+		switch part {
+			case "", ".":
+				continue
+			case "..":
+				if len(resolved) == 0 {
+					return "", errors.New(name + ": The path leads outside of " + root + " through a symlink.")
+				}
+				resolved = resolved[:len(resolved)-1]
+				continue
+		}
+
+		p := filepath.Join(root, filepath.Join(resolved...), part)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode() & os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			return "", errors.New(name + ": The path leads through an absolute symlink: " + target)
+		}
+
+		links++
+		if links > 40 {
+			return "", errors.New(name + ": Too many levels of symbolic links.")
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...), parts[len(parts)-1]), nil
+}
@@ -1,4 +1,4 @@
-package main
+package siren
 
 import (
 	"errors"
@@ -11,7 +11,22 @@ import (
 	"github.com/LEW21/siren/imagectl"
 )
 
-func Pull(ictl *imagectl.ImageCtl, uri, tag string, writer io.Writer) (image imagectl.Image, ret_tag string, ok bool) {
+// ParseGitURI parses git://... and git+SCHEME://... URIs, and strips the "git+" prefix.
+func ParseGitURI(uri string) (*url.URL, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "git" || strings.HasPrefix(u.Scheme, "git+") {
+		u.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	} else {
+		return nil, errors.New("Unsupported scheme: " + u.Scheme)
+	}
+	return u, nil
+}
+
+func Pull(ictl *imagectl.ImageCtl, uri, tag string, opts BuildOptions, writer io.Writer) (image imagectl.Image, ret_tag string, ok bool) {
 	EnsureSirenDirExists()
 
 	defer func(){
@@ -24,39 +39,41 @@ func Pull(ictl *imagectl.ImageCtl, uri, tag string, writer io.Writer) (image ima
 	func(){
 		task := NewTask(writer, "Parsing URI"); defer task.Finish()
 		var err error
-		u, err = url.Parse(uri)
+		u, err = ParseGitURI(uri)
 		task.Require(err)
-
-		if u.Scheme == "git" || strings.HasPrefix(u.Scheme, "git+") {
-			u.Scheme = strings.TrimPrefix(u.Scheme, "git+")
-		} else {
-			task.Require(errors.New("Unsupported scheme: " + u.Scheme))
-		}
 	}()
 
 	fragment := u.Fragment
 	u.Fragment = ""
 
-	uri = u.String()
-	repoRoot := "/var/lib/siren/" + unit.UnitNameEscape(uri)
+	var repoRoot string
+	func(){
+		task := NewTask(writer, "Fetching the repository"); defer task.Finish()
+		var err error
+		repoRoot, err = fetchGitRepo(u.String(), task)
+		task.Require(err)
+	}()
+
 	sourceRoot := repoRoot
 	if fragment != "" {
 		sourceRoot = repoRoot + "/" + fragment
 	}
 
+	return Build(ictl, sourceRoot, tag, opts, writer)
+}
+
+// fetchGitRepo clones the repository to /var/lib/siren, or updates it if it's already there.
+// Returns the path of the clone.
+func fetchGitRepo(uri string, task *Task) (string, error) {
+	repoRoot := "/var/lib/siren/" + unit.UnitNameEscape(uri)
+
 	fi, err := os.Stat(repoRoot)
 	if err != nil {
-		func(){
-			task := NewTask(writer, "Cloning"); defer task.Finish()
-			task.Require(task.RunCommand("git", "clone", uri, repoRoot))
-		}()
-	} else {
-		func(){
-			task := NewTask(writer, "Updating"); defer task.Finish()
-			task.Assert(fi.IsDir(), errors.New(repoRoot + " is not a directory."))
-			task.Require(task.RunCommand("git", "-C", repoRoot, "pull"))
-		}()
+		return repoRoot, task.RunCommand("git", "clone", uri, repoRoot)
 	}
 
-	return Build(ictl, sourceRoot, tag, writer)
+	if !fi.IsDir() {
+		return "", errors.New(repoRoot + " is not a directory.")
+	}
+	return repoRoot, task.RunCommand("git", "-C", repoRoot, "pull")
 }
@@ -0,0 +1,79 @@
+package siren
+
+import (
+	"errors"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// Stage is a build stage - a part of the Sirenfile starting with "STAGE NAME", up to the next STAGE or ID.
+// It is built like an image without ID, and discarded after the build. COPY --from=NAME copies files out of it.
+type Stage struct {
+	Name string
+	BaseName string
+	BaseSources []string
+	Commands []Instruction
+}
+
+// SplitStages separates the build stages from the instructions of the image itself.
+func SplitStages(instructions []Instruction) (stages []Stage, commands []Instruction) {
+	var stage *Stage
+	for _, in := range instructions {
+		switch in.Args[0] {
+			case "STAGE":
+				stages = append(stages, Stage{in.Args[1], "", nil, nil})
+				stage = &stages[len(stages)-1]
+
+			case "ID":
+				stage = nil
+				commands = append(commands, in)
+
+			case "FROM":
+				if stage != nil && stage.BaseName == "" && len(stage.Commands) == 0 {
+					stage.BaseName, stage.BaseSources = in.Args[1], in.Args[2:]
+					break
+				}
+				fallthrough
+
+			default:
+				if stage != nil {
+					stage.Commands = append(stage.Commands, in)
+				} else {
+					commands = append(commands, in)
+				}
+		}
+	}
+	return
+}
+
+// stageImageName is the name of the temporary image a stage is built in when the cache is disabled.
+func stageImageName(stage, suffix string) string {
+	return "siren-stage-" + stage + "-" + suffix
+}
+
+// LookupImage finds the image used by COPY --from: a build stage, or any image (or tag) known to imagectl.
+// The image is mounted if it isn't ready.
+func (b *BuildContext) LookupImage(name string) (imagectl.Image, error) {
+	image, ok := b.Stages[name]
+	if ok && image == nil {
+		return nil, errors.New("Stage " + name + " is empty.")
+	}
+
+	if !ok {
+		if b.ImageCtl == nil {
+			return nil, errors.New("No such stage: " + name)
+		}
+
+		var err error
+		if image, err = b.ImageCtl.GetImage(name); err != nil {
+			return nil, errors.New("No such image or stage: " + name + " (" + err.Error() + ")")
+		}
+	}
+
+	if !image.Ready() {
+		if err := image.SetReady(true); err != nil {
+			return nil, err
+		}
+	}
+	return image, nil
+}
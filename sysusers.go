@@ -0,0 +1,168 @@
+package siren
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SYSUSER and TMPFILE write sysusers.d and tmpfiles.d fragments to /usr/lib, like the other systemd config
+// (see moveSystemdConfigToUsr). systemd creates the users and the files on boot, so they don't have to be in the image.
+
+const sysusersConfig = "/usr/lib/sysusers.d/siren.conf"
+const tmpfilesConfig = "/usr/lib/tmpfiles.d/siren.conf"
+
+// AddSysUser handles "SYSUSER [--apply] TYPE NAME [ID] [GECOS] [HOME] [SHELL]".
+func (b *BuildContext) AddSysUser(arg ...string) error {
+	opts, fields := SplitOptions(arg)
+	if err := CheckSysUser(fields); err != nil {
+		return err
+	}
+
+	line := configLine(fields)
+	if err := b.appendConfigLine(sysusersConfig, line); err != nil {
+		return err
+	}
+
+	if opts.Has("apply") {
+		return b.applyConfigLine(line, "systemd-sysusers", "--root=" + b.Image.Path())
+	}
+	return nil
+}
+
+// AddTmpFile handles "TMPFILE [--apply] TYPE PATH [MODE] [USER] [GROUP] [AGE] [ARGUMENT]".
+func (b *BuildContext) AddTmpFile(arg ...string) error {
+	opts, fields := SplitOptions(arg)
+	if err := CheckTmpFile(fields); err != nil {
+		return err
+	}
+
+	line := configLine(fields)
+	if err := b.appendConfigLine(tmpfilesConfig, line); err != nil {
+		return err
+	}
+
+	if opts.Has("apply") {
+		return b.applyConfigLine(line, "systemd-tmpfiles", "--create", "--remove", "--root=" + b.Image.Path())
+	}
+	return nil
+}
+
+// appendConfigLine adds the line to the config file in the image, unless it is already there.
+func (b *BuildContext) appendConfigLine(name, line string) error {
+	realPath, err := b.ResolvePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(realPath), 0755); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(realPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, existing := range strings.Split(string(content), "\n") {
+		if existing == line {
+			return nil
+		}
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	return ioutil.WriteFile(realPath, append(content, line + "\n"...), 0644)
+}
+
+// applyConfigLine runs the host's systemd tool on the image, with the line as the only config.
+func (b *BuildContext) applyConfigLine(line, name string, arg ...string) error {
+	cmd := exec.Command(name, append(arg, "-")...)
+	cmd.Stdin = strings.NewReader(line + "\n")
+	return b.Task.RunCmd(cmd)
+}
+
+// configLine joins the fields of a sysusers.d or tmpfiles.d line, quoting the ones that need it.
+// Empty fields are written as "-".
+func configLine(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		switch {
+			case field == "":
+				quoted[i] = "-"
+			case strings.ContainsAny(field, " \t\"'\\"):
+				quoted[i] = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(field) + "\""
+			default:
+				quoted[i] = field
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// CheckSysUser checks the fields of a sysusers.d line: TYPE NAME [ID] [GECOS] [HOME] [SHELL].
+func CheckSysUser(fields []string) error {
+	if len(fields) < 2 {
+		return errors.New("SYSUSER requires at least TYPE and NAME.")
+	}
+	typ, name := fields[0], fields[1]
+	id := ""
+	if len(fields) >= 3 {
+		id = fields[2]
+	}
+
+	switch typ {
+		case "u", "u!", "g":
+			if !isValidUserName(name) {
+				return errors.New("Invalid user or group name: " + name)
+			}
+
+		case "m":
+			if !isValidUserName(name) {
+				return errors.New("Invalid user name: " + name)
+			}
+			if !isValidUserName(id) {
+				return errors.New("SYSUSER m requires the name of the group: SYSUSER m USER GROUP")
+			}
+
+		case "r":
+			if name != "-" || id == "" || id == "-" {
+				return errors.New("SYSUSER r requires an ID range: SYSUSER r - FROM-TO")
+			}
+
+		default:
+			return errors.New("Invalid SYSUSER type: " + typ + " (expected u, g, m or r)")
+	}
+	return nil
+}
+
+// Like systemd's valid_user_group_name() in the strict mode.
+func isValidUserName(name string) bool {
+	if len(name) == 0 || len(name) > 31 {
+		return false
+	}
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && (r >= '0' && r <= '9' || r == '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckTmpFile checks the fields of a tmpfiles.d line: TYPE PATH [MODE] [USER] [GROUP] [AGE] [ARGUMENT].
+func CheckTmpFile(fields []string) error {
+	if len(fields) < 2 {
+		return errors.New("TMPFILE requires at least TYPE and PATH.")
+	}
+	typ, path := fields[0], fields[1]
+
+	if typ == "" || !strings.ContainsRune("fwdDevqQpLcbCxXrRzZtThHaA", rune(typ[0])) || strings.Trim(typ[1:], "+!-=~^") != "" {
+		return errors.New("Invalid TMPFILE type: " + typ)
+	}
+	// Paths can start with specifiers, eg. %S.
+	if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "%") {
+		return errors.New("TMPFILE paths have to be absolute: " + path)
+	}
+	return nil
+}
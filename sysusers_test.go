@@ -0,0 +1,45 @@
+package siren
+
+import (
+	"testing"
+)
+
+func TestConfigLine(t *testing.T) {
+	cases := []struct {
+		fields []string
+		want string
+	}{
+		{[]string{"u", "app", "-", "App server", "/var/lib/app"}, `u app - "App server" /var/lib/app`},
+		{[]string{"d", "/var/lib/app", "0750", "app", "app", ""}, `d /var/lib/app 0750 app app -`},
+		{[]string{"f", "/etc/motd", "-", "-", "-", "-", `say "hi"`}, `f /etc/motd - - - - "say \"hi\""`},
+	}
+	for _, c := range cases {
+		if got := configLine(c.fields); got != c.want {
+			t.Errorf("configLine(%q) == %q, want %q", c.fields, got, c.want)
+		}
+	}
+}
+
+func TestCheckSysUserAndTmpFile(t *testing.T) {
+	for _, fields := range [][]string{{"u", "app"}, {"g", "web"}, {"m", "app", "web"}, {"r", "-", "500-900"}} {
+		if err := CheckSysUser(fields); err != nil {
+			t.Errorf("CheckSysUser(%q) == %v", fields, err)
+		}
+	}
+	for _, fields := range [][]string{{"x", "app"}, {"u", "1app"}, {"m", "app"}, {"r", "-"}} {
+		if err := CheckSysUser(fields); err == nil {
+			t.Errorf("CheckSysUser(%q) succeeded", fields)
+		}
+	}
+
+	for _, fields := range [][]string{{"d", "/var/lib/app"}, {"L+", "/etc/localtime"}, {"d!", "%S/app"}} {
+		if err := CheckTmpFile(fields); err != nil {
+			t.Errorf("CheckTmpFile(%q) == %v", fields, err)
+		}
+	}
+	for _, fields := range [][]string{{"y", "/var/lib/app"}, {"d+x", "/var/lib/app"}, {"d", "var/lib/app"}} {
+		if err := CheckTmpFile(fields); err == nil {
+			t.Errorf("CheckTmpFile(%q) succeeded", fields)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package siren
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/LEW21/siren/imagectl"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// Tarballs are extracted in-process, so that the result does not depend on the host's tar and compressors.
+
+// decompress detects the compression of the stream by its magic number.
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(6)
+	switch {
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			return gzip.NewReader(r)
+
+		case bytes.HasPrefix(magic, []byte("BZh")):
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+
+		case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+			xr, err := xz.NewReader(r)
+			return ioutil.NopCloser(xr), err
+
+		case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+
+		default:
+			return ioutil.NopCloser(r), nil
+	}
+}
+
+// ExtractTarball extracts the (possibly compressed) tarball to dst inside root. See ExtractTar.
+func ExtractTarball(tarball, root, dst, subdir string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return errors.New(tarball + ": " + err.Error())
+	}
+	defer r.Close()
+
+	if err := ExtractTar(r, root, dst, subdir); err != nil {
+		return errors.New(tarball + ": " + err.Error())
+	}
+	return nil
+}
+
+// ExtractTar extracts the tar stream to dst, preserving ownership, modes, xattrs, hardlinks and device nodes.
+// If subdir is not empty, only its content is extracted (like with tar --strip-components).
+//
+// dst is a path inside root (eg. of an image). Symlinks already in root (also the absolute ones, like /lib -> usr/lib)
+// are followed like in a chroot. Members containing "..", and members written through symlinks created by the archive
+// that lead outside of dst, are rejected.
+func ExtractTar(r io.Reader, root, dst, subdir string) error {
+	subdir = strings.Trim(path.Clean("/" + subdir), "/")
+
+	realDst, err := imagectl.ResolvePath(root, dst)
+	if err != nil {
+		return err
+	}
+	// Real paths of the symlinks created by the archive.
+	links := map[string]bool{}
+
+	type dirTimes struct {
+		path string
+		hdr *tar.Header
+	}
+	dirs := []dirTimes{}
+
+	found := subdir == ""
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name, ok, err := memberName(hdr.Name, subdir)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		found = true
+		if name == "" {
+			// subdir itself.
+			continue
+		}
+
+		if err := checkMemberParents(root, dst, realDst, name, links); err != nil {
+			return err
+		}
+		target, err := imagectl.ResolvePathNoFollow(root, path.Join(dst, name))
+		if err != nil {
+			return err
+		}
+		// Tarballs don't have to contain the parent directories.
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+			case tar.TypeDir:
+				if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+					if err := os.Remove(target); err != nil {
+						return err
+					}
+				}
+				if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+					return err
+				}
+				// Adding the content changes mtime - it is set at the end.
+				dirs = append(dirs, dirTimes{target, hdr})
+
+			case tar.TypeReg, tar.TypeRegA:
+				if err := removeExisting(target); err != nil {
+					return err
+				}
+				f, err := os.OpenFile(target, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(f, tr)
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					return err
+				}
+
+			case tar.TypeSymlink:
+				// The target is not checked - symlinks are never followed when writing.
+				if err := removeExisting(target); err != nil {
+					return err
+				}
+				if err := os.Symlink(hdr.Linkname, target); err != nil {
+					return err
+				}
+				links[target] = true
+
+			case tar.TypeLink:
+				linkName, ok, err := memberName(hdr.Linkname, subdir)
+				if err != nil {
+					return err
+				}
+				if !ok || linkName == "" {
+					return errors.New(hdr.Name + ": Hard link to a file outside of " + subdir + ": " + hdr.Linkname)
+				}
+				if err := checkMemberParents(root, dst, realDst, linkName, links); err != nil {
+					return err
+				}
+				source, err := imagectl.ResolvePathNoFollow(root, path.Join(dst, linkName))
+				if err != nil {
+					return err
+				}
+				if err := removeExisting(target); err != nil {
+					return err
+				}
+				if err := os.Link(source, target); err != nil {
+					return err
+				}
+				// Shares the metadata with the source.
+				continue
+
+			case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+				mode := uint32(unix.S_IFIFO)
+				if hdr.Typeflag == tar.TypeChar {
+					mode = unix.S_IFCHR
+				} else if hdr.Typeflag == tar.TypeBlock {
+					mode = unix.S_IFBLK
+				}
+				if err := removeExisting(target); err != nil {
+					return err
+				}
+				dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+				if err := unix.Mknod(target, mode | 0600, int(dev)); err != nil {
+					return &os.PathError{Op: "mknod", Path: target, Err: err}
+				}
+
+			case tar.TypeXGlobalHeader:
+				continue
+
+			default:
+				return errors.New(hdr.Name + ": Unsupported member type: " + string(hdr.Typeflag))
+		}
+
+		if err := applyHeader(target, hdr); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return errors.New("No " + subdir + " directory in the tarball.")
+	}
+
+	// In reverse - so that the parents are set after their children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := applyHeader(dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMemberParents fails if a parent directory of the member is a symlink created by the archive (in links)
+// leading outside of dst.
+func checkMemberParents(root, dst, realDst, name string, links map[string]bool) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := path.Join(dst, strings.Join(parts[:i], "/"))
+		link, err := imagectl.ResolvePathNoFollow(root, parent)
+		if err != nil {
+			return err
+		}
+		if !links[link] {
+			continue
+		}
+		resolved, err := imagectl.ResolvePath(root, parent)
+		if err != nil {
+			return err
+		}
+		if resolved != realDst && !strings.HasPrefix(resolved, realDst + "/") {
+			return errors.New(name + ": Member escapes the destination directory through a symlink.")
+		}
+	}
+	return nil
+}
+
+// memberName makes the member name relative to subdir. Returns false for members outside of subdir.
+func memberName(name, subdir string) (string, bool, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false, errors.New(name + ": Member escapes the destination directory.")
+		}
+	}
+
+	// Leading "/" are stripped, like in GNU tar.
+	name = strings.Trim(path.Clean("/" + name), "/")
+
+	switch {
+		case subdir == "":
+			return name, true, nil
+		case name == subdir:
+			return "", true, nil
+		case strings.HasPrefix(name, subdir + "/"):
+			return name[len(subdir)+1:], true, nil
+		default:
+			return "", false, nil
+	}
+}
+
+func removeExisting(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// applyHeader sets the ownership, mode, xattrs and times of the extracted member.
+func applyHeader(target string, hdr *tar.Header) error {
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+
+	symlink := hdr.Typeflag == tar.TypeSymlink
+
+	// After chown - it clears the setuid and setgid bits.
+	if !symlink {
+		if err := os.Chmod(target, hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+		if err := unix.Lsetxattr(target, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value), 0); err != nil && !symlink {
+			return &os.PathError{Op: "setxattr", Path: target, Err: err}
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{timespec(atime), timespec(hdr.ModTime)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "utimes", Path: target, Err: err}
+	}
+	return nil
+}
+
+func timespec(t time.Time) unix.Timespec {
+	return unix.NsecToTimespec(t.UnixNano())
+}
@@ -0,0 +1,147 @@
+package siren
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarMember struct {
+	typeflag byte
+	name, content, linkname string
+}
+
+func makeTar(t *testing.T, members []tarMember) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, m := range members {
+		hdr := &tar.Header{Typeflag: m.typeflag, Name: m.name, Linkname: m.linkname, Mode: 0640, Size: int64(len(m.content)), Uid: os.Getuid(), Gid: os.Getgid()}
+		if m.typeflag == tar.TypeDir {
+			hdr.Mode = 0750
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(m.content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func extract(t *testing.T, members []tarMember, subdir string) (string, error) {
+	dir, err := ioutil.TempDir("", "siren-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, extractTo(t, members, dir, "/", subdir)
+}
+
+func extractTo(t *testing.T, members []tarMember, root, dst, subdir string) error {
+	r, err := decompress(bufio.NewReader(bytes.NewReader(makeTar(t, members))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ExtractTar(r, root, dst, subdir)
+}
+
+func TestExtractTar(t *testing.T) {
+	members := []tarMember{
+		{tar.TypeDir, "app-1.0/", "", ""},
+		{tar.TypeReg, "app-1.0/bin/app", "binary", ""},
+		{tar.TypeSymlink, "app-1.0/app", "", "bin/app"},
+		{tar.TypeLink, "app-1.0/bin/app2", "", "app-1.0/bin/app"},
+		{tar.TypeReg, "other/file", "other", ""},
+	}
+
+	dir, err := extract(t, members, "app-1.0")
+	defer os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"bin/app", "app", "bin/app2"} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(content) != "binary" {
+			t.Errorf("%v == %q, %v, want %q", name, content, err, "binary")
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "bin/app")); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("bin/app mode == %v, %v, want %v", fi.Mode(), err, os.FileMode(0640))
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "other")); err == nil {
+		t.Errorf("other was extracted, but it is outside of the subdir")
+	}
+
+	dir, err = extract(t, members, "missing")
+	os.RemoveAll(dir)
+	if err == nil {
+		t.Errorf("ExtractTar() with a missing subdir succeeded")
+	}
+}
+
+func TestExtractTarEscapes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Extracted to /opt/app - writes to the rest of the image escape the destination.
+	cases := [][]tarMember{
+		{{tar.TypeReg, "../escaped", "x", ""}},
+		{{tar.TypeLink, "passwd", "", "../../etc/passwd"}},
+		{{tar.TypeSymlink, "etc", "", "/etc"}, {tar.TypeReg, "etc/escaped", "x", ""}},
+		{{tar.TypeSymlink, "up", "", "../.."}, {tar.TypeReg, "up/escaped", "x", ""}},
+		{{tar.TypeSymlink, "up", "", "../.."}, {tar.TypeLink, "passwd", "", "up/etc/passwd"}},
+		{{tar.TypeSymlink, "a", "", "b"}, {tar.TypeSymlink, "b", "", "/"}, {tar.TypeReg, "a/escaped", "x", ""}},
+	}
+	for _, members := range cases {
+		image := filepath.Join(dir, "image")
+		os.RemoveAll(image)
+		os.MkdirAll(filepath.Join(image, "etc"), 0755)
+		ioutil.WriteFile(filepath.Join(image, "etc/passwd"), []byte("root"), 0644)
+
+		if err := extractTo(t, members, image, "/opt/app", ""); err == nil {
+			t.Errorf("ExtractTar(%v) succeeded", members)
+		}
+		for _, name := range []string{"escaped", "etc/escaped", "opt/escaped"} {
+			if _, err := os.Lstat(filepath.Join(image, name)); err == nil {
+				t.Errorf("ExtractTar(%v) wrote %v", members, name)
+			}
+		}
+	}
+
+	// Symlinks of the archive leading inside the destination, and absolute symlinks already in the image
+	// (like /lib -> /usr/lib in distributions) are followed.
+	image := filepath.Join(dir, "image")
+	os.RemoveAll(image)
+	os.MkdirAll(filepath.Join(image, "usr/lib"), 0755)
+	os.Symlink("/usr/lib", filepath.Join(image, "lib"))
+	members := []tarMember{
+		{tar.TypeDir, "run/", "", ""},
+		{tar.TypeSymlink, "var/run", "", "/run"},
+		{tar.TypeReg, "var/run/app.pid", "1", ""},
+		{tar.TypeReg, "lib/libapp.so", "x", ""},
+	}
+	if err := extractTo(t, members, image, "/", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"run/app.pid", "usr/lib/libapp.so"} {
+		if _, err := os.Lstat(filepath.Join(image, name)); err != nil {
+			t.Errorf("%v was not extracted: %v", name, err)
+		}
+	}
+
+	if err := extractTo(t, []tarMember{{tar.TypeSymlink, "current", "", "v1"}, {tar.TypeReg, "current/app", "x", ""}}, image, "/opt/app", ""); err != nil {
+		t.Errorf("ExtractTar() through a symlink inside the destination == %v", err)
+	} else if _, err := os.Lstat(filepath.Join(image, "opt/app/v1/app")); err != nil {
+		t.Errorf("current/app was not extracted to v1/app: %v", err)
+	}
+}
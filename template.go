@@ -0,0 +1,175 @@
+package siren
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is available in the templates rendered by TEMPLATE, eg. {{.Version}} or {{.OSRelease.ID}}.
+type TemplateData struct {
+	Name, Version string // From ID.
+	Args map[string]string // Build arguments.
+	Labels map[string]string // Set with LABEL so far, including the ones of the base image.
+	OSRelease map[string]string // /etc/os-release of the image.
+}
+
+// templateState returns the TemplateData coming from the BuildContext, for the cache key.
+// OSRelease comes from the image - it is a part of the parent layer.
+func (b *BuildContext) templateState() string {
+	state := b.Name + "\x00" + b.Version + "\x00"
+	for _, values := range []map[string]string{b.Args, b.Labels} {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			state += key + "=" + values[key] + "\x00"
+		}
+		state += "\x00"
+	}
+	return state
+}
+
+// Template handles "TEMPLATE [--mode=MODE] SRC DST".
+func (b *BuildContext) Template(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	src, dst := arg[0], b.ImagePath(arg[1])
+
+	srcPath, err := b.RealPath(src)
+	if err != nil {
+		return err
+	}
+	text, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+
+	// Unknown keys are errors, not "<no value>".
+	tmpl, err := template.New(src).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return err
+	}
+
+	osRelease, err := b.readOSRelease()
+	if err != nil {
+		return err
+	}
+
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, TemplateData{b.Name, b.Version, b.Args, b.Labels, osRelease}); err != nil {
+		return err
+	}
+
+	realDst, err := b.ResolvePath(dst)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(realDst); strings.HasSuffix(dst, "/") || err == nil && fi.IsDir() {
+		// foo.conf.tmpl -> DST/foo.conf
+		if realDst, err = b.ResolvePath(path.Join(dst, strings.TrimSuffix(path.Base(src), ".tmpl"))); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(realDst, out.Bytes(), opts.Get("mode"), false)
+}
+
+// readOSRelease reads /etc/os-release of the image, or /usr/lib/os-release if there is none.
+// Returns an empty map if there are none.
+func (b *BuildContext) readOSRelease() (map[string]string, error) {
+	for _, name := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		realPath, err := b.ResolvePath(name)
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(realPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return ParseOSRelease(string(content)), nil
+	}
+	return map[string]string{}, nil
+}
+
+// ParseOSRelease parses the KEY=VALUE lines of os-release. Values can be quoted like in the shell.
+func ParseOSRelease(content string) map[string]string {
+	values := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		eq := strings.Index(line, "=")
+		if eq <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		value := line[eq+1:]
+		if parts, _, err := parseLine(value); err == nil && len(parts) == 1 {
+			value = parts[0]
+		}
+		values[line[:eq]] = value
+	}
+	return values
+}
+
+// writeFile writes (or appends) the content to the file. Without mode, new files get 0644,
+// and the existing ones keep their modes.
+func writeFile(realPath string, content []byte, mode string, appendTo bool) error {
+	perm := os.FileMode(0644)
+	if mode != "" {
+		var err error
+		if perm, err = ParseMode(mode); err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendTo {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, err := os.OpenFile(realPath, flags, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if mode != "" {
+		// Also for existing files, and regardless of umask.
+		return os.Chmod(realPath, perm)
+	}
+	return nil
+}
+
+// appendLine returns the content to append to the file as a new line.
+func appendLine(realPath, value string) (string, error) {
+	content, err := ioutil.ReadFile(realPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		value = "\n" + value
+	}
+	if !strings.HasSuffix(value, "\n") {
+		value += "\n"
+	}
+	return value, nil
+}
+
+// CheckTemplate parses the template, for Lint.
+func CheckTemplate(name, text string) error {
+	_, err := template.New(name).Parse(text)
+	return err
+}
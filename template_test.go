@@ -0,0 +1,58 @@
+package siren
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseOSRelease(t *testing.T) {
+	in := `NAME="Arch Linux"
+ID=arch
+# Comment
+VERSION_ID=''
+HOME_URL="https://archlinux.org/"
+`
+	want := map[string]string{"NAME": "Arch Linux", "ID": "arch", "VERSION_ID": "", "HOME_URL": "https://archlinux.org/"}
+	if got := ParseOSRelease(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseOSRelease() == %q, want %q", got, want)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(path, []byte("127.0.0.1 localhost"), 0600)
+
+	for _, value := range []string{"10.0.0.1 db", "10.0.0.2 web\n"} {
+		line, err := appendLine(path, value)
+		if err == nil {
+			err = writeFile(path, []byte(line), "", true)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "127.0.0.1 localhost\n10.0.0.1 db\n10.0.0.2 web\n"
+	if content, _ := ioutil.ReadFile(path); string(content) != want {
+		t.Errorf("content == %q, want %q", content, want)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode == %v, want the existing %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	if err := writeFile(path, []byte("x"), "0640", false); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+		t.Errorf("mode == %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+}
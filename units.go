@@ -0,0 +1,281 @@
+package siren
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var unitSuffixes = []string{".service", ".socket", ".timer", ".path", ".target", ".mount", ".automount", ".swap", ".slice", ".scope", ".device"}
+
+func hasUnitSuffix(name string) bool {
+	for _, suffix := range unitSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unitName adds ".service" to names without a unit type suffix.
+func unitName(name string) string {
+	if hasUnitSuffix(name) {
+		return name
+	}
+	return name + ".service"
+}
+
+// unitFile returns the name of the file defining the unit - for instances of templates, it is the template
+// (foo@bar.service -> foo@.service).
+func unitFile(name string) string {
+	at := strings.Index(name, "@")
+	dot := strings.LastIndex(name, ".")
+	if at < 0 || dot < at {
+		return name
+	}
+	return name[:at+1] + name[dot:]
+}
+
+// isDropIn checks if the path is a drop-in directory (foo.service.d), or a file inside one.
+func isDropIn(name string) bool {
+	for _, part := range []string{path.Base(name), path.Base(path.Dir(name))} {
+		if strings.HasSuffix(part, ".d") && hasUnitSuffix(strings.TrimSuffix(part, ".d")) {
+			return true
+		}
+	}
+	return false
+}
+
+// unitSource returns the path of the file (or the drop-in) ADD_UNIT and ENABLE take from the build directory.
+func unitSource(name string) string {
+	if isDropIn(name) {
+		return name
+	}
+	return unitFile(unitName(name))
+}
+
+func unitDir(user bool) string {
+	if user {
+		return "/usr/lib/systemd/user/"
+	}
+	return "/usr/lib/systemd/system/"
+}
+
+// CheckUnitName checks if the name (without the default ".service" suffix) is a valid unit name.
+// Like systemd's unit_name_is_valid(), but more strict - escaped characters are allowed only as \x sequences.
+func CheckUnitName(name string) error {
+	name = unitName(name)
+	prefix := name[:strings.LastIndex(name, ".")]
+	if len(name) > 255 || prefix == "" || strings.Count(prefix, "@") > 1 || strings.HasPrefix(prefix, "@") {
+		return errors.New("Invalid unit name: " + name)
+	}
+	for _, r := range prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(":-_.\\@", r)) {
+			return errors.New("Invalid unit name: " + name)
+		}
+	}
+	return nil
+}
+
+func (b *BuildContext) addUnit(name string, user bool) error {
+	dst := unitDir(user)
+	if dir := path.Base(path.Dir(name)); isDropIn(name) && dir != "." && !isDropIn(path.Base(name)) {
+		// A file of a drop-in - copied into the drop-in directory.
+		dst += dir + "/"
+	}
+	return b.Copy(name, dst)
+}
+
+// AddUnit handles "ADD_UNIT [--user] UNIT | ADD_UNIT [--user] UNIT.d[/FILE]".
+func (b *BuildContext) AddUnit(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	return b.addUnit(unitSource(arg[0]), opts.Has("user"))
+}
+
+// Enable handles "ENABLE [--user] [--preset] UNIT".
+func (b *BuildContext) Enable(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	name, user := unitName(arg[0]), opts.Has("user")
+
+	if err := b.addUnit(unitFile(name), user); err != nil && !b.hasUnit(unitFile(name), user) {
+		fmt.Fprintln(b.Task, "Warning: " + unitFile(name) + " is neither in the build directory, nor in the image.")
+	}
+
+	return b.enableUnit(name, user, opts.Has("preset"))
+}
+
+// hasUnit checks if the unit file is installed in the image.
+func (b *BuildContext) hasUnit(file string, user bool) bool {
+	kind := "system"
+	if user {
+		kind = "user"
+	}
+	for _, dir := range []string{"/etc/systemd/", "/usr/lib/systemd/", "/lib/systemd/"} {
+		realPath, err := b.ResolvePath(dir + kind + "/" + file)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(realPath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *BuildContext) enableUnit(name string, user, preset bool) error {
+	if preset {
+		return b.setPreset("enable", name, user)
+	}
+	return b.systemctl(user, "enable", name)
+}
+
+// Service handles "SERVICE [--user] [--enable [--preset]] [--no-verify] UNIT" followed by the unit file, and END.
+func (b *BuildContext) Service(body string, arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	name, user := unitName(arg[0]), opts.Has("user")
+
+	realPath, err := b.ResolvePath(unitDir(user) + name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(realPath), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(realPath, []byte(body), 0644); err != nil {
+		return err
+	}
+
+	if !opts.Has("no-verify") {
+		if err := b.verifyUnit(realPath); err != nil {
+			return err
+		}
+	}
+
+	if opts.Has("enable") {
+		return b.enableUnit(name, user, opts.Has("preset"))
+	}
+	return nil
+}
+
+// systemd-analyze verify supports --root since systemd 250.
+const verifyRootVersion = 250
+
+// verifyUnit checks the unit file with the host's systemd-analyze verify, if it is recent enough.
+func (b *BuildContext) verifyUnit(realPath string) error {
+	out, err := exec.Command("systemd-analyze", "--version").Output()
+	if err != nil {
+		fmt.Fprintln(b.Task, "systemd-analyze not found - not verifying the unit.")
+		return nil
+	}
+
+	// "systemd 255 (255.4-1)"
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return nil
+	}
+	if version, err := strconv.Atoi(fields[1]); err != nil || version < verifyRootVersion {
+		fmt.Fprintln(b.Task, "systemd-analyze verify does not support --root - not verifying the unit.")
+		return nil
+	}
+
+	if err := b.Task.RunCommand("systemd-analyze", "verify", "--root=" + b.Image.Path(), realPath); err != nil {
+		return errors.New("The unit failed the verification (use --no-verify to skip it): " + err.Error())
+	}
+	return nil
+}
+
+// Disable handles "DISABLE [--user] [--preset] UNIT". Also removes the enablement symlinks
+// moved to /usr/lib by the builds of the base images, which systemctl disable doesn't touch.
+func (b *BuildContext) Disable(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	name, user := unitName(arg[0]), opts.Has("user")
+
+	if opts.Has("preset") {
+		return b.setPreset("disable", name, user)
+	}
+
+	if err := b.systemctl(user, "disable", name); err != nil {
+		return err
+	}
+
+	dir, err := b.ResolvePath(unitDir(user))
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".wants") && !strings.HasSuffix(e.Name(), ".requires") && !strings.HasSuffix(e.Name(), ".upholds") {
+			continue
+		}
+		if err := removeExisting(filepath.Join(dir, e.Name(), name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mask handles "MASK [--user] UNIT".
+func (b *BuildContext) Mask(arg ...string) error {
+	opts, arg := SplitOptions(arg)
+	return b.systemctl(opts.Has("user"), "mask", unitName(arg[0]))
+}
+
+// systemctl runs systemctl in the image, as root. User units are changed for all the users.
+func (b *BuildContext) systemctl(user bool, verb, name string) error {
+	return b.Task.RunCmd(b.systemctlCommand(user, verb, name))
+}
+
+func (b *BuildContext) systemctlCommand(user bool, verb, name string) *exec.Cmd {
+	if user {
+		return b.rootCommand("systemctl", "--global", verb, name)
+	}
+	return b.rootCommand("systemctl", verb, name)
+}
+
+// setPreset sets the preset of the unit in the preset file of siren, instead of creating the symlinks.
+// systemd applies the presets on the first boot, and with systemctl preset-all.
+func (b *BuildContext) setPreset(verb, name string, user bool) error {
+	presetFile := "/usr/lib/systemd/system-preset/50-siren.preset"
+	if user {
+		presetFile = "/usr/lib/systemd/user-preset/50-siren.preset"
+	}
+
+	// Instances are given after the template: "enable foo@.service bar".
+	unit := name
+	if file := unitFile(name); file != name {
+		unit = file + " " + name[strings.Index(name, "@")+1:strings.LastIndex(name, ".")]
+	}
+
+	realPath, err := b.ResolvePath(presetFile)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(realPath), 0755); err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(realPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The first matching line wins - so the earlier ones for the same unit are replaced.
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		if fields := strings.Fields(line); line != "" && (len(fields) < 2 || strings.Join(fields[1:], " ") != unit) {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, verb + " " + unit)
+
+	return ioutil.WriteFile(realPath, []byte(strings.Join(lines, "\n") + "\n"), 0644)
+}
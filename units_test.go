@@ -0,0 +1,94 @@
+package siren
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LEW21/siren/imagectl"
+)
+
+// testImage is an image known only by its name and path - enough to build its commands, and to change its files.
+type testImage struct {
+	imagectl.Image
+	name, path string
+}
+
+func (i testImage) Name() string {
+	return i.name
+}
+
+func (i testImage) Path() string {
+	return i.path
+}
+
+func TestUnitSource(t *testing.T) {
+	cases := []struct {
+		name, want string
+	}{
+		{"app", "app.service"},
+		{"app.timer", "app.timer"},
+		{"getty@tty1.service", "getty@.service"},
+		{"getty@tty1", "getty@.service"},
+		{"backup@.timer", "backup@.timer"},
+		{"app.service.d", "app.service.d"},
+		{"app.service.d/override.conf", "app.service.d/override.conf"},
+		{"units/app", "units/app.service"},
+	}
+	for _, c := range cases {
+		if got := unitSource(c.name); got != c.want {
+			t.Errorf("unitSource(%q) == %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	for _, name := range []string{"app", "getty@tty1.service", "dev-sda1.device", "foo@.service"} {
+		if err := CheckUnitName(name); err != nil {
+			t.Errorf("CheckUnitName(%q) == %v", name, err)
+		}
+	}
+	for _, name := range []string{".service", "@foo.service", "a@b@c.service", "app/x.service"} {
+		if err := CheckUnitName(name); err == nil {
+			t.Errorf("CheckUnitName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestSystemctlIgnoresUser(t *testing.T) {
+	b := NewBuildContext(nil, "", nil)
+	b.Image = testImage{nil, "test", ""}
+	b.SetUser("app:app")
+	b.WorkDir = "/srv"
+
+	for _, user := range []bool{false, true} {
+		cmd := b.systemctlCommand(user, "enable", "foo.service")
+		args := strings.Join(cmd.Args, " ")
+		if strings.Contains(args, "app") || strings.Contains(args, "--chdir") || strings.Contains(args, "runuser") {
+			t.Errorf("systemctl after USER and WORKDIR == %q, want it run as root in /", args)
+		}
+	}
+}
+
+func TestHasUnit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siren-units")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "usr/lib/systemd/system"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "usr/lib/systemd/system/sshd.service"), []byte("[Service]\n"), 0644)
+
+	b := NewBuildContext(nil, "", nil)
+	b.Image = testImage{nil, "test", dir}
+
+	if !b.hasUnit("sshd.service", false) {
+		t.Errorf("hasUnit(sshd.service) == false, want true")
+	}
+	if b.hasUnit("sshd.service", true) {
+		t.Errorf("hasUnit(sshd.service, user) == true, want false")
+	}
+	if b.hasUnit("nginx.service", false) {
+		t.Errorf("hasUnit(nginx.service) == true, want false")
+	}
+}
@@ -0,0 +1,137 @@
+package siren
+
+import (
+	"errors"
+	"strings"
+)
+
+// ExpandVariables handles ARG instructions, and replaces ${NAME} with the value of the
+// build argument NAME in all the arguments of the remaining instructions.
+// "$${" can be used to get a literal "${". Names not declared with ARG are left as they are, with a Warning
+// (see expandInstructions) - they may be typos, or shell variables, eg. in RUN sh -c 'echo ${HOME}'.
+// Values from buildArgs (--build-arg) override the defaults given in the Sirenfile.
+// Heredoc bodies are left as they are - they are usually shell scripts, with their own variables.
+func ExpandVariables(instructions []Instruction, buildArgs map[string]string) ([]Instruction, error) {
+	expanded, _, _, err := expandInstructions(instructions, buildArgs)
+	return expanded, err
+}
+
+// expandInstructions is ExpandVariables, also returning the values of the build arguments that are set,
+// and Warnings about the names that are not declared.
+func expandInstructions(instructions []Instruction, buildArgs map[string]string) ([]Instruction, map[string]string, []error, error) {
+	vars := map[string]*string{}
+	warnings := []error{}
+
+	expanded := make([]Instruction, 0, len(instructions))
+
+	for _, in := range instructions {
+		args := make([]string, len(in.Args))
+		for i, arg := range in.Args {
+			var undeclared []string
+			var err error
+			args[i], undeclared, err = expandVariables(arg, vars)
+			if err != nil {
+				return nil, nil, nil, in.Errorf(i, "%v", err)
+			}
+			for _, name := range undeclared {
+				warnings = append(warnings, in.Warnf(i, "${%v} is not a build argument - left as it is. Declare it with ARG, or write $${%v} if it is meant for the shell.", name, name))
+			}
+		}
+
+		if args[0] != "ARG" {
+			in.Args = args
+			expanded = append(expanded, in)
+			continue
+		}
+
+		if len(args) < 2 {
+			return nil, nil, nil, in.Errorf(0, "ARG requires at least one argument.")
+		}
+
+		name := args[1]
+		var value *string
+		if eq := strings.Index(name, "="); eq >= 0 {
+			v := name[eq+1:]
+			name, value = name[:eq], &v
+		} else if len(args) >= 3 {
+			value = &args[2]
+		}
+
+		if !isVariableName(name) {
+			return nil, nil, nil, in.Errorf(1, "Invalid build argument name: %v", name)
+		}
+
+		if v, ok := buildArgs[name]; ok {
+			value = &v
+		}
+		vars[name] = value
+	}
+
+	values := map[string]string{}
+	for name, value := range vars {
+		if value != nil {
+			values[name] = *value
+		}
+	}
+	return expanded, values, warnings, nil
+}
+
+// expandVariables replaces the declared variables in s. Also returns the valid names that are not declared.
+func expandVariables(s string, vars map[string]*string) (string, []string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil, nil
+	}
+
+	undeclared := []string{}
+
+	res := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$${") {
+			res = append(res, "${"...)
+			i += 2
+			continue
+		}
+
+		if !strings.HasPrefix(s[i:], "${") {
+			res = append(res, s[i])
+			continue
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			res = append(res, s[i:]...)
+			break
+		}
+
+		name := s[i+2:i+end]
+		value, declared := vars[name]
+		if !declared {
+			if isVariableName(name) {
+				undeclared = append(undeclared, name)
+			}
+			res = append(res, s[i:i+end+1]...)
+			i += end
+			continue
+		}
+		if value == nil {
+			return "", nil, errors.New("Build argument " + name + " is not set. Use --build-arg " + name + "=VALUE or give it a default value.")
+		}
+
+		res = append(res, *value...)
+		i += end
+	}
+
+	return string(res), undeclared, nil
+}
+
+func isVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}